@@ -0,0 +1,113 @@
+package loghamster
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default number of data frames sent without acknowledgement
+const defaultAckWindow = 16
+
+// Time to wait for the server to acknowledge sent data
+const ackTimeout = 30 * time.Second
+
+// errAckTimeout is returned if the server did not acknowledge data in time
+var errAckTimeout = errors.New("timeout waiting for acknowledgement from server")
+
+// ackTracker follows the acknowledgements of the server for the data
+// frames sent over one connection
+type ackTracker struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	acked    int64   // Offset up to which the server acknowledged all data
+	inflight []int64 // End offsets of frames not acknowledged yet
+	err      error   // Reason the connection failed
+}
+
+// newAckTracker returns a tracker for data sent starting at the offset
+func newAckTracker(offset int64) *ackTracker {
+	acks := ackTracker{acked: offset}
+	acks.cond = sync.NewCond(&acks.mutex)
+	return &acks
+}
+
+// run reads acknowledgements from the server until the connection fails.
+// Format: ACK <offset>
+func (acks *ackTracker) run(reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			acks.fail(err)
+			return
+		}
+		var offset int64
+		if _, err := fmt.Sscanf(strings.TrimSpace(line), "ACK %d", &offset); err != nil {
+			acks.fail(fmt.Errorf("unexpected response from server: %s", strings.TrimSpace(line)))
+			return
+		}
+		acks.ack(offset)
+	}
+}
+
+// sent records a frame sent with data up to the end offset
+func (acks *ackTracker) sent(end int64) {
+	acks.mutex.Lock()
+	defer acks.mutex.Unlock()
+	acks.inflight = append(acks.inflight, end)
+}
+
+// ack records all data up to the offset as acknowledged
+func (acks *ackTracker) ack(offset int64) {
+	acks.mutex.Lock()
+	defer acks.mutex.Unlock()
+	if offset > acks.acked {
+		acks.acked = offset
+	}
+	i := 0
+	for i < len(acks.inflight) && acks.inflight[i] <= acks.acked {
+		i++
+	}
+	acks.inflight = acks.inflight[i:]
+	acks.cond.Broadcast()
+}
+
+// fail wakes up all waiting senders after the connection failed
+func (acks *ackTracker) fail(err error) {
+	acks.mutex.Lock()
+	defer acks.mutex.Unlock()
+	if acks.err == nil {
+		acks.err = err
+	}
+	acks.cond.Broadcast()
+}
+
+// Acked returns the offset up to which all data was acknowledged
+func (acks *ackTracker) Acked() int64 {
+	acks.mutex.Lock()
+	defer acks.mutex.Unlock()
+	return acks.acked
+}
+
+// waitInflight blocks until at most max frames are not acknowledged
+func (acks *ackTracker) waitInflight(max int) error {
+	acks.mutex.Lock()
+	defer acks.mutex.Unlock()
+	deadline := time.Now().Add(ackTimeout)
+	timer := time.AfterFunc(ackTimeout, func() {
+		acks.mutex.Lock()
+		acks.cond.Broadcast()
+		acks.mutex.Unlock()
+	})
+	defer timer.Stop()
+	for acks.err == nil && len(acks.inflight) > max {
+		if time.Now().After(deadline) {
+			return errAckTimeout
+		}
+		acks.cond.Wait()
+	}
+	return acks.err
+}
@@ -0,0 +1,63 @@
+package loghamster
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestAckTracker(t *testing.T) {
+	tests := []struct {
+		sent     []int64
+		acks     []int64
+		acked    int64
+		inflight int
+	}{
+		{[]int64{10, 20, 30}, nil, 0, 3},
+		{[]int64{10, 20, 30}, []int64{10}, 10, 2},
+		{[]int64{10, 20, 30}, []int64{15}, 15, 2},
+		{[]int64{10, 20, 30}, []int64{30}, 30, 0},
+		{[]int64{10, 20, 30}, []int64{20, 10}, 20, 1},
+		{[]int64{10, 20, 30}, []int64{40}, 40, 0},
+	}
+	for _, test := range tests {
+		acks := newAckTracker(0)
+		for _, end := range test.sent {
+			acks.sent(end)
+		}
+		for _, offset := range test.acks {
+			acks.ack(offset)
+		}
+		if acked := acks.Acked(); acked != test.acked {
+			t.Errorf("sent %v acks %v: acked %d, want %d", test.sent, test.acks, acked, test.acked)
+		}
+		if len(acks.inflight) != test.inflight {
+			t.Errorf("sent %v acks %v: %d frames in flight, want %d", test.sent, test.acks, len(acks.inflight), test.inflight)
+		}
+		if err := acks.waitInflight(test.inflight); err != nil {
+			t.Errorf("sent %v acks %v: %v", test.sent, test.acks, err)
+		}
+	}
+}
+
+func TestAckTrackerRun(t *testing.T) {
+	acks := newAckTracker(100)
+	acks.sent(150)
+	acks.sent(200)
+	acks.run(bufio.NewReader(strings.NewReader("ACK 150\nACK 200\n")))
+	if acked := acks.Acked(); acked != 200 {
+		t.Errorf("acked %d, want 200", acked)
+	}
+	if err := acks.waitInflight(0); err != io.EOF {
+		t.Errorf("got error %v, want %v", err, io.EOF)
+	}
+
+	acks = newAckTracker(0)
+	acks.sent(10)
+	acks.run(bufio.NewReader(strings.NewReader("ERR broken\n")))
+	if err := acks.waitInflight(0); err == nil || errors.Is(err, io.EOF) {
+		t.Errorf("got error %v, want unexpected response", err)
+	}
+}
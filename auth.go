@@ -0,0 +1,137 @@
+package loghamster
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Environment variable with the token of the client, overrides the token file
+const tokenEnvVariable = "LOGHAMSTER_TOKEN"
+
+// Credentials authenticate a client by the ID and secret of its token
+type Credentials struct {
+	ID     string
+	Secret []byte
+}
+
+// serverToken is a token known by the server with the hostnames it may claim
+type serverToken struct {
+	id     string
+	secret []byte
+	hosts  []*pattern
+}
+
+// readSecret returns the secret, read from the file if not set directly
+func readSecret(secret string, path string) ([]byte, error) {
+	if secret == "" && path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		secret = string(data)
+	}
+	secret = strings.TrimSpace(secret)
+	if secret == "" {
+		return nil, nil
+	}
+	return []byte(secret), nil
+}
+
+// LoadCredentials returns the credentials of the client from the
+// environment or the token file, or nil if no token is configured.
+// The token ID defaults to the hostname of the client.
+func LoadCredentials(id string, path string, hostname string) (*Credentials, error) {
+	secret, err := readSecret(os.Getenv(tokenEnvVariable), path)
+	if err != nil || secret == nil {
+		return nil, err
+	}
+	if id == "" {
+		id = hostname
+	}
+	return &Credentials{ID: id, Secret: secret}, nil
+}
+
+// loadServerTokens returns the token table of the server by token ID. A
+// token without hosts may only claim the hostname equal to its ID.
+func loadServerTokens(conf AuthConfig) (map[string]*serverToken, error) {
+	tokens := map[string]*serverToken{}
+	for _, t := range conf.Token {
+		if t.ID == "" {
+			return nil, fmt.Errorf("token without id")
+		}
+		secret, err := readSecret(t.Token, t.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		if secret == nil {
+			return nil, fmt.Errorf("no secret for token %s", t.ID)
+		}
+		token := serverToken{id: t.ID, secret: secret}
+		hosts := t.Hosts
+		if len(hosts) == 0 {
+			hosts = []string{t.ID}
+		}
+		for _, raw := range hosts {
+			p, err := newHostPattern(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid host pattern %s for token %s: %v", raw, t.ID, err)
+			}
+			if p != nil {
+				token.hosts = append(token.hosts, p)
+			}
+		}
+		tokens[t.ID] = &token
+	}
+	if conf.Enabled && len(tokens) == 0 {
+		return nil, fmt.Errorf("authentication enabled without tokens")
+	}
+	return tokens, nil
+}
+
+// generateNonce returns a random challenge for the client
+func generateNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal().Err(err).Msg("Failed to generate nonce")
+	}
+	return hex.EncodeToString(b)
+}
+
+// computeMAC returns the response to the challenge for a secret
+func computeMAC(secret []byte, nonce string, streamID string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(nonce + ":" + streamID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authenticate checks the response of a client to the challenge and
+// returns the token used, or nil if the authentication failed
+func (server *Server) authenticate(nonce string, streamID string, id string, response string) *serverToken {
+	token, ok := server.tokens[id]
+	if !ok {
+		return nil
+	}
+	expected := computeMAC(token.secret, nonce, streamID)
+	if !hmac.Equal([]byte(expected), []byte(response)) {
+		return nil
+	}
+	return token
+}
+
+// allowsHost returns true if the token may claim the hostname
+func (token *serverToken) allowsHost(hostname string) bool {
+	for _, p := range token.hosts {
+		if p.Match(hostname) {
+			return true
+		}
+	}
+	return false
+}
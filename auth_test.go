@@ -0,0 +1,31 @@
+package loghamster
+
+import "testing"
+
+func TestServerTokenAllowsHost(t *testing.T) {
+	tokens, err := loadServerTokens(AuthConfig{Enabled: true, Token: []authToken{
+		{ID: "web1", Token: "secret"},
+		{ID: "relay", Token: "secret", Hosts: []string{"app-*", "~sip[0-9]+"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		token    string
+		hostname string
+		allowed  bool
+	}{
+		{"web1", "web1", true},
+		{"web1", "web10", false},
+		{"relay", "app-1", true},
+		{"relay", "sip7", true},
+		{"relay", "sip7.example", false},
+		{"relay", "evilsip7", false},
+		{"relay", "relay", false},
+	}
+	for _, test := range tests {
+		if allowed := tokens[test.token].allowsHost(test.hostname); allowed != test.allowed {
+			t.Errorf("%s claiming %s: got %v, want %v", test.token, test.hostname, allowed, test.allowed)
+		}
+	}
+}
@@ -1,47 +1,142 @@
 package loghamster
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
 )
 
+// errInputTruncated is returned when the input file was truncated and the
+// stream must be initialized again to mark the restart on the server
+var errInputTruncated = errors.New("input file truncated")
+
 // Client handles a loghamster client connection
 type Client struct {
-	server  string
-	streams []*ClientLogStream
-	Files   *FileManager
+	server     string
+	streams    []*ClientLogStream
+	Files      *FileManager
+	state      *StateFile
+	Hostname   string                 // Hostname of the client sent to the server
+	Compress   string                 // Compression method requested for stream data
+	TLS        *tls.Config            // Encrypt connections to the server, if set
+	Auth       *Credentials           // Authenticate with a token, if set
+	Window     int                    // Maximum number of data chunks sent without acknowledgement
+	limiter    *rate.Limiter          // Bandwidth limit shared by all streams
+	WatchDir   func(dir string) error // Watch a directory for new files of glob and directory inputs
+	mutex      sync.Mutex
+	startMutex sync.Mutex // Serializes the creation of streams
+	Multiplex  bool       // Send all streams within a session over a single connection
+	session    *session
+	drained    map[fileID]string // Input of the files drained by streams after a rotation
 }
 
 // ClientLogStream handles a log stream
 type ClientLogStream struct {
 	*LogStream
-	server    string
-	InputFile *os.File
-	LastPos   int64
-	LastRead  time.Time
+	server      string
+	name        string            // Logical name of the input
+	source      string            // Logical file name sent on INIT instead of the path, if set
+	spool       bool              // Input file is a spool file, removed once rotated and drained
+	labels      map[string]string // Metadata of the input sent on INIT
+	InputFile   *os.File
+	LastPos     int64 // Position of the data read and sent
+	committed   int64 // Position of the data acknowledged by the server, saved in the state file
+	LastRead    time.Time
+	fileID      fileID
+	detached    bool   // input path no longer refers to the open input file
+	fpSum       uint32 // Checksum of the first fpLen bytes of the input file
+	fpLen       int64
+	truncated   int64       // Position the input file was truncated at, reported on next INIT
+	compress    string      // Compression method requested on INIT
+	codec       *wireCodec  // Compression of data frames, if accepted by the server
+	acks        *ackTracker // Acknowledgements of data frames sent over the connection
+	window      int
+	client      *Client
+	channel     *channel      // Channel within the session of the client, if multiplexed
+	retireAfter time.Duration // Retire the stream after the input file vanished, for glob and directory inputs
+	throttle    *throttle     // Bandwidth limits of the input and the client
+	changed     chan struct{} // Signals the stream loop that the file watcher saw a change
+	lines       *lineFramer   // Send complete lines only, if set
+	tls         *tls.Config   // Encrypt the connection, if set
+	auth        *Credentials
+	state       *StateFile
+	mutex       sync.Mutex
 }
 
-// NewClient initiates a new client connection
-func NewClient(server string, files *FileManager) *Client {
+// NewClient initiates a new client connection, stream positions are
+// restored from and saved to the provided state file. Without a state file
+// checkpoints and sent files are only kept in memory.
+func NewClient(server string, files *FileManager, state *StateFile) *Client {
+	if state == nil {
+		state = NewStateFile("")
+	}
 	streams := []*ClientLogStream{}
-	client := Client{server, streams, files}
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to detect hostname")
+	}
+	client := Client{server: server, streams: streams, Files: files, state: state, Hostname: hostname, Window: defaultAckWindow}
 	return &client
 }
 
-// NewLogStream initiates a new log stream
-func (client *Client) NewLogStream(hostname string, file string) (*ClientLogStream, error) {
-	stream := NewLogStream(client.server, hostname, file)
+// NewLogStream initiates a new log stream for the file of the input,
+// resuming at the position recorded in the state file
+func (client *Client) NewLogStream(input InputFile, file string) (*ClientLogStream, error) {
+	return client.newLogStream(input, file, "")
+}
+
+// newLogStream initiates a new log stream for the file of the input, sent
+// to the server as the logical file name of the source if set
+func (client *Client) newLogStream(input InputFile, file string, source string) (*ClientLogStream, error) {
+	stream := NewLogStream(client.server, client.Hostname, file)
+	stream.name = input.Name
+	stream.source = source
+	stream.spool = input.SpoolDir != ""
+	stream.labels = validLabels(input.Labels)
+	stream.compress = client.Compress
+	stream.tls = client.TLS
+	stream.auth = client.Auth
+	stream.window = client.Window
+	stream.client = client
+	stream.throttle = newThrottle(input.Name, input.limiter, client.limiter)
+	stream.lines = newLineFramer(input)
+	stream.state = client.state
+	stream.restoreState()
 	stream.Connect()
 
-	client.addStream(&stream)
-	return &stream, nil
+	client.addStream(stream)
+	return stream, nil
+}
+
+// SetRateLimit limits the bandwidth of all streams of the client to the
+// rate in bytes per second, the burst defaults to the rate
+func (client *Client) SetRateLimit(limit int, burst int) {
+	client.limiter = newRateLimiter(limit, burst)
+	if client.limiter != nil {
+		log.Info().Int("ratelimit", limit).Int("burst", client.limiter.Burst()).Msg("Limiting bandwidth of all streams")
+	}
+}
+
+// getSession returns the session multiplexing the streams of the client
+func (client *Client) getSession() *session {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.session == nil {
+		client.session = &session{client: client}
+	}
+	return client.session
 }
 
 // CloseLogStream closes a log stream
@@ -52,6 +147,8 @@ func (client *Client) CloseLogStream(stream *ClientLogStream) {
 
 // AddStream will add a ClientLogStream to the list of monitored streams
 func (client *Client) addStream(stream *ClientLogStream) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
 	client.streams = append(client.streams, stream)
 	log.Debug().Str("stream", stream.streamID).Int("count", len(client.streams)).Str("server", stream.server).Msg("Added log stream to monitored streams")
 	return nil
@@ -59,6 +156,8 @@ func (client *Client) addStream(stream *ClientLogStream) error {
 
 // RemoveStream will search for a stream in streams list
 func (client *Client) removeStream(stream *ClientLogStream) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
 	removed := false
 	for i, s := range client.streams {
 		if s == stream {
@@ -76,6 +175,8 @@ func (client *Client) removeStream(stream *ClientLogStream) error {
 
 // FindStreamByPath will search for a stream in streams list
 func (client *Client) FindStreamByPath(path string) *ClientLogStream {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
 	var stream *ClientLogStream
 	streams := client.streams
 	for i, s := range streams {
@@ -91,45 +192,38 @@ func (client *Client) FindStreamByPath(path string) *ClientLogStream {
 	return stream
 }
 
-// HandleFileChange shall trigger a stream read/write (read from file write to target)
-// TODO: May not be called on every write
+// HandleFileChange shall trigger a stream read/write (read from file write to target).
+// The data is sent by the stream loop, so throttled or unacknowledged
+// streams never block the file watcher.
 func (client *Client) HandleFileChange(path string) error {
 	stream := client.FindStreamByPath(path)
 	if stream != nil {
-		if stream.InputFile == nil {
-			stream.OpenInputFile(0)
-		}
-		if _, err := stream.sendData(); err != nil {
-			log.Error().Err(err).Str("stream", stream.streamID).Str("path", stream.filename).Msg("Failed to send data to stream")
-			client.CloseLogStream(stream)
-		}
-	} else {
-		if client.Files.FindInputByPath(path) != nil {
-			client.NewLogStream(client.server, path)
-		}
+		stream.notify()
+	} else if input := client.Files.FindInputByPath(path); input != nil && isRegularFile(path) {
+		client.StartStream(*input, path)
 	}
 	return nil
 }
 
-// HandleFileCreate shall reopen an existing stream or create a new stream
+// HandleFileCreate shall follow an existing stream to the newly created
+// file (after draining the rotated file) or create a new stream
 func (client *Client) HandleFileCreate(path string) error {
 	stream := client.FindStreamByPath(path)
 	if stream != nil {
-		stream.OpenInputFile(0)
-		stream.sendData()
-	} else {
-		if client.Files.FindInputByPath(path) != nil {
-			client.NewLogStream(client.server, path)
-		}
+		stream.notify()
+	} else if input := client.Files.FindInputByPath(path); input != nil && isRegularFile(path) {
+		client.StartStream(*input, path)
 	}
 	return nil
 }
 
-// HandleFileDelete shall close an existing stream
+// HandleFileDelete shall drain an existing stream after the file was
+// renamed or removed. The input file is kept open, so data written before
+// the rotation is still sent, until the new file is created.
 func (client *Client) HandleFileDelete(path string) error {
 	stream := client.FindStreamByPath(path)
 	if stream != nil {
-		stream.Close()
+		stream.notify()
 	} else {
 		log.Debug().Str("path", path).Msg("No stream found for path")
 	}
@@ -137,70 +231,325 @@ func (client *Client) HandleFileDelete(path string) error {
 }
 
 // NewLogStream stream
-func NewLogStream(server, hostname, filename string) ClientLogStream {
-	source := LogStream{nil, "", hostname, filename}
-	s := ClientLogStream{&source, server, nil, 0, time.Now()}
-	return s
+func NewLogStream(server, hostname, filename string) *ClientLogStream {
+	source := LogStream{streamID: "", hostname: hostname, filename: filename}
+	s := ClientLogStream{LogStream: &source, server: server, LastRead: time.Now(), changed: make(chan struct{}, 1)}
+	return &s
+}
+
+// restoreState sets the last position from the state file, if the
+// recorded file is still the same file (same device/inode) and did not shrink
+func (stream *ClientLogStream) restoreState() {
+	if stream.state == nil {
+		return
+	}
+	checkpoint, ok := stream.state.Get(stream.filename)
+	if !ok {
+		log.Debug().Str("path", stream.filename).Msg("No checkpoint found in state file, starting from beginning")
+		return
+	}
+	id := fileID{}
+	info, err := os.Stat(stream.filename)
+	if err == nil {
+		id = getFileID(info)
+	}
+	last := fileID{Device: checkpoint.Device, Inode: checkpoint.Inode}
+	if checkpoint.Inode != 0 && id != last {
+		// Rotated while not running, send the remainder of the rotated file first
+		rotated := findFileByID(filepath.Dir(stream.filename), last)
+		if rotated != "" && stream.openRotatedFile(rotated, checkpoint) == nil {
+			return
+		}
+		log.Info().Str("path", stream.filename).Uint64("inode", id.Inode).Uint64("lastInode", checkpoint.Inode).Msg("Input file was replaced since checkpoint, starting from beginning")
+		return
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("path", stream.filename).Msg("Unable to stat input file, ignoring checkpoint")
+		return
+	}
+	if info.Size() < checkpoint.Offset {
+		log.Info().Str("path", stream.filename).Int64("size", info.Size()).Int64("pos", checkpoint.Offset).Msg("Input file shrunk since checkpoint, starting from beginning")
+		metricInputTruncationsTotal.Inc()
+		stream.truncated = checkpoint.Offset
+		return
+	}
+	stream.LastPos = checkpoint.Offset
+	stream.committed = checkpoint.Offset
+	stream.LastRead = checkpoint.LastRead
+	stream.fpSum = checkpoint.Fingerprint
+	stream.fpLen = checkpoint.FingerprintSize
+	log.Info().Str("path", stream.filename).Int64("pos", stream.LastPos).Time("lastRead", stream.LastRead).Msg("Resuming input file from checkpoint")
+}
+
+// openRotatedFile opens the rotated file of the checkpoint at the recorded
+// position. The stream switches to the input path after draining it.
+func (stream *ClientLogStream) openRotatedFile(path string, checkpoint StreamState) error {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Warn().Err(err).Str("path", path).Msg("Failed to open rotated input file")
+		return err
+	}
+	info, err := file.Stat()
+	if err == nil && info.Size() < checkpoint.Offset {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		_, err = file.Seek(checkpoint.Offset, io.SeekStart)
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("path", path).Int64("pos", checkpoint.Offset).Msg("Unable to resume rotated input file")
+		file.Close()
+		return err
+	}
+	stream.InputFile = file
+	stream.fileID = fileID{Device: checkpoint.Device, Inode: checkpoint.Inode}
+	stream.detached = true
+	stream.LastPos = checkpoint.Offset
+	stream.committed = checkpoint.Offset
+	stream.LastRead = checkpoint.LastRead
+	stream.fpSum = checkpoint.Fingerprint
+	stream.fpLen = checkpoint.FingerprintSize
+	log.Info().Str("path", stream.filename).Str("rotated", path).Int64("pos", stream.LastPos).Msg("Resuming rotated input file from checkpoint")
+	return nil
+}
+
+// saveState writes the current position of the stream to the state file
+func (stream *ClientLogStream) saveState() {
+	if stream.state == nil {
+		return
+	}
+	err := stream.state.Update(StreamState{
+		Path:     stream.filename,
+		Device:   stream.fileID.Device,
+		Inode:    stream.fileID.Inode,
+		Offset:   stream.committed,
+		LastRead: stream.LastRead,
+
+		Fingerprint:     stream.fpSum,
+		FingerprintSize: stream.fpLen,
+	})
+	if err != nil {
+		log.Error().Err(err).Str("path", stream.filename).Str("statefile", stream.state.Path).Msg("Failed to write state file")
+	}
 }
 
 // Connect the stream
 func (stream *ClientLogStream) Connect() error {
+	source := stream.filename
+	if stream.source != "" {
+		source = stream.source
+	}
+	init := fmt.Sprintf("INIT STREAM %s:%s", escapeArg(stream.hostname), escapeArg(source))
+	if stream.name != "" {
+		init = init + fmt.Sprintf(" name:%s", escapeArg(stream.name))
+	}
+	init = init + formatMeta(stream.labels)
+	if stream.truncated > 0 {
+		init = init + fmt.Sprintf(" truncated:%d", stream.truncated)
+	}
+	if stream.compress != "" {
+		init = init + fmt.Sprintf(" compress:%s", stream.compress)
+	}
+	if id := stream.sourceID(); id != (fileID{}) {
+		init = init + fmt.Sprintf(" fileid:%d.%d", id.Device, id.Inode)
+	}
+	line, err := stream.open(init)
+	if err != nil {
+		return err
+	}
+	log.Debug().Str("stream", stream.streamID).Str("line", line).Msg("Response")
+	if !strings.HasPrefix(line, "OK") {
+		log.Info().Str("response", strings.TrimSpace(line)).Msg("Failed to init stream")
+		stream.Disconnect()
+		return fmt.Errorf("stream not accepted by server: %s", strings.TrimSpace(line))
+	}
+	stream.truncated = 0
+	if held, ok := responseArg(line, "offset"); ok {
+		if offset, err := strconv.ParseInt(held, 10, 64); err == nil {
+			stream.resumeAt(offset)
+		}
+	}
+
+	stream.codec = nil
+	if accepted, _ := responseArg(line, "compress"); isWireCompression(accepted) {
+		codec, err := newWireCodec(accepted)
+		if err != nil {
+			stream.Disconnect()
+			return err
+		}
+		stream.codec = codec
+		log.Debug().Str("stream", stream.streamID).Str("compress", accepted).Msg("Compressing stream data")
+	} else if stream.compress != "" {
+		log.Info().Str("stream", stream.streamID).Str("compress", stream.compress).Msg("Compression not accepted by server, sending uncompressed")
+	}
+	// The server acknowledges data frames until the connection is closed
+	stream.acks = newAckTracker(stream.LastPos)
+	if stream.channel != nil {
+		stream.channel.start(stream.acks)
+	} else {
+		go stream.acks.run(stream.reader)
+	}
+	return nil
+}
+
+// open sends INIT for the stream within the session of the client, or
+// over a connection of its own if sessions are not used, and returns the
+// response of the server
+func (stream *ClientLogStream) open(init string) (string, error) {
+	if stream.client != nil && stream.client.Multiplex {
+		ch, line, err := stream.client.getSession().open(init)
+		if err == nil {
+			if fields := strings.Fields(line); len(fields) > 1 && strings.HasPrefix(line, "OK") {
+				stream.channel = ch
+				stream.streamID = fields[1]
+			}
+			return line, nil
+		}
+		if err != errSessionUnsupported {
+			log.Error().Err(err).Str("path", stream.filename).Msg("Failed to open stream within session")
+			return "", err
+		}
+	}
+	if err := stream.dial(); err != nil {
+		return "", err
+	}
+	stream.writeMessage(init)
+	line, err := stream.awaitMessage()
+	if err != nil {
+		log.Error().Err(err).Str("stream", stream.streamID).Msg("ERROR on awaitResponse:")
+		if strings.Contains(err.Error(), "timeout") {
+			log.Error().Err(err).Msg("Timeout detected on stream")
+			stream.Disconnect()
+		}
+		return "", err
+	}
+	return line, nil
+}
+
+// connected returns true if the stream is connected to the server, over a
+// connection of its own or within a session
+func (stream *ClientLogStream) connected() bool {
+	return stream.conn != nil || stream.channel != nil
+}
+
+// sourceID returns the ID of the input file to identify the data held by
+// the server
+func (stream *ClientLogStream) sourceID() fileID {
+	if stream.fileID != (fileID{}) {
+		return stream.fileID
+	}
+	info, err := os.Stat(stream.filename)
+	if err != nil {
+		return fileID{}
+	}
+	return getFileID(info)
+}
+
+// resumeAt continues the stream at the offset of the input file the server
+// already holds, so data is neither missing nor sent twice, even if the
+// state file of the client is lost or outdated
+func (stream *ClientLogStream) resumeAt(offset int64) {
+	if offset == stream.LastPos {
+		return
+	}
+	var info os.FileInfo
+	var err error
+	if stream.InputFile != nil {
+		info, err = stream.InputFile.Stat()
+	} else {
+		info, err = os.Stat(stream.filename)
+	}
+	if err != nil || offset > info.Size() {
+		log.Warn().Err(err).Str("stream", stream.streamID).Str("path", stream.filename).Int64("offset", offset).Int64("pos", stream.LastPos).Msg("Server holds more data than the input file, ignoring offset")
+		return
+	}
+	log.Info().Str("stream", stream.streamID).Str("path", stream.filename).Int64("offset", offset).Int64("pos", stream.LastPos).Msg("Resuming at offset held by server")
+	stream.LastPos = offset
+	stream.committed = offset
+	if stream.InputFile != nil {
+		if _, err := stream.InputFile.Seek(offset, io.SeekStart); err != nil {
+			log.Error().Err(err).Str("path", stream.filename).Int64("pos", offset).Msg("Failed to seek input file")
+		}
+	}
+	stream.resumeLines()
+	stream.saveState()
+}
+
+// dial connects to the server and awaits the welcome message and stream ID
+func (stream *ClientLogStream) dial() error {
 	// connect to this socket
-	conn, err := net.Dial("tcp", stream.server)
+	var conn net.Conn
+	var err error
+	if stream.tls != nil {
+		conn, err = tls.Dial("tcp", stream.server, stream.tls)
+	} else {
+		conn, err = net.Dial("tcp", stream.server)
+	}
 	if err != nil {
 		log.Error().Err(err).Str("server", stream.server).Msg("Failed to connect to server")
 		return err
 	}
-	stream.conn = conn
+	stream.setConn(conn)
 
 	line, err := stream.awaitMessage()
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to await Hello from server. Aborting")
-		stream.Close()
+		stream.Disconnect()
 		return err
 	}
 	log.Info().Str("server", line).Msg("Connected to server")
 	line, err = stream.awaitMessage()
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to await StreamID from server. Aborting")
-		stream.Close()
+		stream.Disconnect()
 		return err
 	}
 	resp := strings.Split(strings.Trim(line, "\n"), " ")
 	log.Debug().Str("response", line).Msg("Response")
-	if resp[0] != "STREAMID" {
+	if resp[0] != "STREAMID" || len(resp) < 2 {
 		log.Info().Msg("Could not identify stream ID, aborting")
-		stream.Close()
-		return err
+		stream.Disconnect()
+		return fmt.Errorf("unexpected response from server: %s", strings.TrimSpace(line))
 	}
 	stream.streamID = resp[1]
 	log.Debug().Str("stream", stream.streamID).Msg("Received streamID from server")
+	if len(resp) >= 4 && resp[2] == "AUTH" {
+		return stream.authenticate(resp[3])
+	}
+	return nil
+}
 
-	stream.writeMessage(fmt.Sprintf("INIT STREAM %s:%s", stream.hostname, stream.filename))
-	line, err = stream.awaitMessage()
+// authenticate answers the challenge of the server with the token
+func (stream *ClientLogStream) authenticate(nonce string) error {
+	if stream.auth == nil {
+		log.Debug().Str("stream", stream.streamID).Msg("Server offers authentication, but no token configured")
+		return nil
+	}
+	stream.writeMessage(fmt.Sprintf("AUTH %s %s", stream.auth.ID, computeMAC(stream.auth.Secret, nonce, stream.streamID)))
+	line, err := stream.awaitMessage()
 	if err != nil {
-		log.Error().Err(err).Str("stream", stream.streamID).Msg("ERROR on awaitResponse:")
-		if strings.Contains(err.Error(), "timeout") {
-			log.Error().Err(err).Msg("Timeout detected on stream")
-			stream.Close()
-		}
+		stream.Disconnect()
 		return err
 	}
-	log.Debug().Str("stream", stream.streamID).Str("line", line).Msg("Response")
 	if !strings.HasPrefix(line, "OK") {
-		log.Info().Msg("Failed to init stream")
-		stream.Close()
+		log.Error().Str("stream", stream.streamID).Str("token", stream.auth.ID).Str("response", strings.TrimSpace(line)).Msg("Authentication failed")
+		stream.Disconnect()
+		return fmt.Errorf("authentication not accepted by server: %s", strings.TrimSpace(line))
 	}
+	log.Debug().Str("stream", stream.streamID).Str("token", stream.auth.ID).Msg("Authenticated at server")
 	return nil
 }
 
-// Reconnect the underlying connection
+// Reconnect the underlying connection. The stream is locked while
+// connecting, as the server may set a new position to resume at.
 func (stream *ClientLogStream) Reconnect() error {
 	log.Debug().Str("stream", stream.streamID).Msg("Reconnecting stream, closing and reconnecting")
-	stream.Close()
+	stream.drop()
 	time.Sleep(1 * time.Second)
 	log.Info().Str("stream", stream.filename).Msg("Reconnecting stream for path")
+	stream.mutex.Lock()
 	err := stream.Connect()
+	stream.mutex.Unlock()
 	if err != nil {
 		log.Error().Err(err).Msg("Unable to reconnect")
 		return err
@@ -209,7 +558,8 @@ func (stream *ClientLogStream) Reconnect() error {
 	return nil
 }
 
-// StreamFile will search for a stream in streams list
+// StreamFile will stream the file starting at lastPos and follow
+// the file, reopening at the last sent position after errors
 func (stream *ClientLogStream) StreamFile(path string, lastPos int64) (int64, error) {
 	total := int64(0)
 	var lastErr error
@@ -217,9 +567,19 @@ func (stream *ClientLogStream) StreamFile(path string, lastPos int64) (int64, er
 	retry := 0
 	const maxDelay = 30
 
+	// The file watcher may have started sending the file already
+	stream.mutex.Lock()
+	if stream.InputFile == nil {
+		stream.LastPos = lastPos
+	}
+	stream.mutex.Unlock()
 	for {
+		if stream.retireDue() {
+			stream.retire()
+			return total, nil
+		}
 		log.Info().Msg("Starting loop for stream file data")
-		if stream.conn == nil {
+		if !stream.isConnected() {
 			log.Warn().Msg("No valid connection available, connecting...")
 			err := stream.Reconnect()
 			if err != nil {
@@ -227,12 +587,17 @@ func (stream *ClientLogStream) StreamFile(path string, lastPos int64) (int64, er
 			}
 		}
 
-		err = stream.OpenInputFile(lastPos)
+		err = stream.reopenInputFile()
 		if err != nil {
+			if os.IsNotExist(err) {
+				log.Warn().Str("path", path).Msg("Input file does not exist, waiting for file")
+				time.Sleep(5 * time.Second)
+				continue
+			}
 			log.Error().Err(err).Str("path", path).Msg("Unable to open file")
 			return total, err
 		}
-		if stream.conn != nil {
+		if stream.isConnected() {
 			n, err := stream.streamFileData()
 			total = total + n
 			log.Debug().Err(err).Int64("read", n).Int64("pos", stream.LastPos).Msg("Stream data completed")
@@ -249,7 +614,7 @@ func (stream *ClientLogStream) StreamFile(path string, lastPos int64) (int64, er
 				}
 
 				log.Error().Err(err).Msgf("Waiting %d seconds before reconnect", delay)
-				time.Sleep(time.Duration(delay))
+				time.Sleep(time.Duration(delay) * time.Second)
 				err := stream.Reconnect()
 				if err != nil {
 					log.Error().Err(err).Msg("Error during reconnect")
@@ -271,67 +636,157 @@ func (stream *ClientLogStream) StreamFile(path string, lastPos int64) (int64, er
 	return total, lastErr
 }
 
-// sendData will read data and write to the steam connection
-// TODO: this operation must be synced
+// sendData will read new data of the input file and send it in frames.
+// The committed position only advances with the acknowledgements of the
+// server, data not acknowledged is sent again after reconnecting.
 func (stream *ClientLogStream) sendData() (int64, error) {
 	if stream.InputFile == nil {
 		log.Error().Msg("Input file is nil, return ErrClosedPipe")
 		return 0, io.ErrClosedPipe
 	}
-	if stream.conn == nil {
+	if !stream.connected() || stream.acks == nil {
 		log.Error().Msg("Connection is nil, return ErrClosedPipe")
 		return 0, io.ErrClosedPipe
 	}
+	window := stream.window
+	if window < 1 {
+		window = 1
+	}
 	total := int64(0)
-	bufsize := int64(defaultBuffersize)
-	// stream.InputFile.Seek(stream.LastPos, 0)
+	size := defaultBuffersize
+	if stream.lines != nil {
+		size = stream.lines.bufferSize()
+	}
+	buf := make([]byte, size)
 	for {
+		// Limit the number of frames not acknowledged yet
+		if err := stream.acks.waitInflight(window - 1); err != nil {
+			log.Error().Err(err).Str("stream", stream.streamID).Int64("pos", stream.LastPos).Msg("Data not acknowledged by server")
+			stream.Disconnect()
+			return total, err
+		}
 		log.Trace().Str("path", stream.filename).Int64("pos", stream.LastPos).Msg("Sending data from pos")
-		n, err := io.CopyN(stream.conn, stream.InputFile, bufsize)
-		if n > 0 && (err == nil || err == io.EOF) {
-			log.Trace().Int64("n", n).Msg("Sent to stream")
-			stream.LastPos = stream.LastPos + n
-			stream.LastRead = time.Now()
-			total = total + n
+		// Lines up to the maximum length must fit in, the throttle waits
+		// for larger data in pieces
+		chunk := buf
+		if stream.lines == nil {
+			chunk = buf[:stream.throttle.chunkSize(len(buf))]
 		}
-		if err != nil {
-			if err == io.EOF {
-				break
+		n, err := stream.InputFile.Read(chunk)
+		// In line mode only complete lines are sent, the rest is read again
+		data, consumed, source := buf[:n], n, -1
+		var records []int
+		if stream.lines != nil && n > 0 {
+			data, consumed, records = stream.lines.frame(buf[:n], stream.LastPos, n == len(chunk))
+			if consumed < n {
+				if _, err := stream.InputFile.Seek(stream.LastPos+int64(consumed), io.SeekStart); err != nil {
+					log.Error().Err(err).Str("path", stream.filename).Msg("Failed to seek input file")
+					stream.Disconnect()
+					return total, err
+				}
 			}
-			log.Error().Err(err).Str("path", stream.filename).Msg("Error during stream data")
-			stream.Close()
-			// Strange workaround to restore correct position, to avoid sending too few data
-			if (err == io.ErrClosedPipe || err == io.ErrUnexpectedEOF || strings.Contains(err.Error(), "broken pipe")) && total > int64(defaultBuffersize) {
-				log.Warn().Msg("Apply workaround to avoid wrong position")
-				total = total - int64(defaultBuffersize)
+			if len(data) != consumed {
+				source = consumed
+			}
+		}
+		if consumed > 0 {
+			stream.throttle.wait(len(data))
+			if err := stream.sendFrame(data, source, records); err != nil {
+				log.Error().Err(err).Str("path", stream.filename).Msg("Error during stream data")
+				stream.Disconnect()
+				return total, err
+			}
+			log.Trace().Int("n", consumed).Msg("Sent to stream")
+			metricBytesSentTotal.Add(len(data))
+			metricRecordsSentTotal.Add(len(records))
+			stream.LastPos = stream.LastPos + int64(consumed)
+			stream.LastRead = time.Now()
+			total = total + int64(consumed)
+			if stream.detached {
+				metricInputRotatedBytesTotal.Add(consumed)
 			}
-			return total, err
 		}
-		if n == 0 {
+		if err == io.EOF || consumed == 0 {
 			break
 		}
+		if err != nil {
+			log.Error().Err(err).Str("path", stream.filename).Msg("Error reading input file")
+			stream.Disconnect()
+			return total, err
+		}
 	}
 	if total > 0 {
 		log.Debug().Str("stream", stream.streamID).Str("path", stream.filename).Int64("bytes", total).Msg("Sent data to stream")
+		stream.updateFingerprint()
 	} else {
 		log.Trace().Str("stream", stream.streamID).Str("path", stream.filename).Msg("No data sent to stream")
 	}
+	stream.commit()
 	return total, nil
 }
 
+// sendFrame sends the data read at the current position in a frame,
+// compressed if accepted by the server. The source length covered by the
+// data is given, if the data differs from the input file (>= 0), and the
+// records of the data, if lines are grouped.
+func (stream *ClientLogStream) sendFrame(data []byte, source int, records []int) error {
+	payload := data
+	if stream.codec != nil {
+		var err error
+		if payload, err = stream.codec.Encode(data); err != nil {
+			return err
+		}
+	}
+	// Record the frame first, the acknowledgement may arrive before writeFrame returns
+	h := frameHeader{offset: stream.LastPos, source: source, records: records}
+	end := stream.LastPos + int64(len(data))
+	if source >= 0 {
+		end = stream.LastPos + int64(source)
+	}
+	stream.acks.sent(end)
+	if stream.channel != nil {
+		return stream.channel.writeFrame(h, payload)
+	}
+	return writeFrame(countingWriter{stream.conn, metricBytesSentWireTotal}, h, payload)
+}
+
+// commit advances the committed position to the data acknowledged by the
+// server and saves it in the state file
+func (stream *ClientLogStream) commit() {
+	if stream.acks == nil {
+		return
+	}
+	acked := stream.acks.Acked()
+	if acked <= stream.committed || acked > stream.LastPos {
+		return
+	}
+	metricBytesAckedTotal.Add(int(acked - stream.committed))
+	stream.committed = acked
+	stream.saveState()
+}
+
+// drainAcks waits until the server acknowledged all data sent
+func (stream *ClientLogStream) drainAcks() error {
+	if stream.acks != nil {
+		if err := stream.acks.waitInflight(0); err != nil {
+			return err
+		}
+		stream.commit()
+	}
+	if stream.committed != stream.LastPos {
+		return io.ErrClosedPipe
+	}
+	return nil
+}
+
 // StreamFile will search for a stream in streams list
 func (stream *ClientLogStream) streamFileData() (total int64, err error) {
 	log.Info().Str("path", stream.filename).Int64("pos", stream.LastPos).Msg("Stream file from position")
 	for {
-		n, err := stream.sendData()
+		n, err := stream.syncData()
 		if err != nil {
 			log.Error().Err(err).Str("path", stream.filename).Msg("Error during stream data")
-			stream.Close()
-			// Strange workaround to restore correct position, to avoid sending too few data
-			if (err == io.ErrClosedPipe || err == io.ErrUnexpectedEOF || strings.Contains(err.Error(), "broken pipe")) && total > int64(defaultBuffersize) {
-				log.Warn().Msg("Apply workaround to avoid wrong position")
-				total = total - int64(defaultBuffersize)
-			}
+			stream.drop()
 			break
 		}
 		if n > 0 {
@@ -340,18 +795,40 @@ func (stream *ClientLogStream) streamFileData() (total int64, err error) {
 		} else {
 			idle := time.Now().Sub(stream.LastRead)
 			log.Debug().Str("path", stream.filename).Dur("idle", idle).Msg("Idle input file")
+			if stream.retireDue() {
+				break
+			}
 			if idle > 5*time.Second {
-				time.Sleep(30 * time.Second)
+				stream.waitChange(30 * time.Second)
 			} else {
-				time.Sleep(2 * time.Second)
+				stream.waitChange(2 * time.Second)
 			}
-
 		}
 	}
 	log.Info().Str("stream", stream.streamID).Str("path", stream.filename).Int64("bytes", total).Msg("Sent data to stream")
 	return total, nil
 }
 
+// notify wakes up the stream loop to send new data of the input file or
+// follow a rotation, without waiting for it
+func (stream *ClientLogStream) notify() {
+	select {
+	case stream.changed <- struct{}{}:
+	default:
+	}
+}
+
+// waitChange waits until the file watcher saw a change of the input file,
+// at most for the duration
+func (stream *ClientLogStream) waitChange(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-stream.changed:
+	case <-timer.C:
+	}
+}
+
 // OpenInputFile will open the inputfile for reading starting at
 // the provided position
 func (stream *ClientLogStream) OpenInputFile(pos int64) error {
@@ -364,11 +841,11 @@ func (stream *ClientLogStream) OpenInputFile(pos int64) error {
 	}
 	stream.InputFile = file
 	info, _ := stream.InputFile.Stat()
-	log.Info().Str("path", stream.filename).Int64("size", info.Size()).Msg("Opened input file")
+	stream.fileID = getFileID(info)
+	log.Info().Str("path", stream.filename).Int64("size", info.Size()).Uint64("inode", stream.fileID.Inode).Msg("Opened input file")
 	if info.Size() < pos {
-		log.Info().Int64("pos", stream.LastPos).Int64("size", info.Size()).Msg("Last position greater than file size. Starting from beginning")
-		// TODO: Handle rotation gracefully
-		stream.LastPos = 0
+		log.Info().Int64("pos", pos).Int64("size", info.Size()).Msg("Last position greater than file size. Starting from beginning")
+		pos = 0
 	}
 	seekpos, err := stream.InputFile.Seek(pos, 0)
 	if err != nil {
@@ -376,10 +853,185 @@ func (stream *ClientLogStream) OpenInputFile(pos int64) error {
 	}
 	log.Debug().Str("path", stream.filename).Int64("pos", seekpos).Msg("Seeked to pos in input file")
 	stream.LastPos = seekpos
+	stream.committed = seekpos
+	stream.resumeLines()
 
 	return nil
 }
 
+// reopenInputFile will open the input file at the last position, an input
+// file that is still open (maybe already rotated) is kept and rewound to the
+// last position instead, so no data is lost on reconnects
+func (stream *ClientLogStream) reopenInputFile() error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if stream.InputFile == nil {
+		return stream.OpenInputFile(stream.LastPos)
+	}
+	_, err := stream.InputFile.Seek(stream.LastPos, io.SeekStart)
+	return err
+}
+
+// syncData sends all new data of the input file to the server and
+// follows the input path to a new file after a rotation. It is called
+// from the stream loop, the file watcher only signals changes.
+func (stream *ClientLogStream) syncData() (int64, error) {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if stream.InputFile == nil {
+		if err := stream.OpenInputFile(stream.LastPos); err != nil {
+			return 0, err
+		}
+	}
+	if err := stream.checkTruncation(); err != nil {
+		return 0, err
+	}
+	total, err := stream.sendData()
+	if err != nil {
+		return total, err
+	}
+	// The open input file is drained now, so it is safe to switch
+	rotated, err := stream.followRotation()
+	if err != nil || !rotated {
+		return total, err
+	}
+	n, err := stream.sendData()
+	return total + n, err
+}
+
+// followRotation checks if the input path still refers to the open input
+// file (same device/inode). If the file was replaced, the stream switches
+// to the new file starting at the beginning, the way tail -F does.
+// The old file must be drained before.
+func (stream *ClientLogStream) followRotation() (bool, error) {
+	info, err := os.Stat(stream.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if !stream.detached {
+				log.Info().Str("stream", stream.streamID).Str("path", stream.filename).Int64("pos", stream.LastPos).Msg("Input file moved away, draining old file until new file appears")
+				stream.detached = true
+			}
+			return false, nil
+		}
+		return false, err
+	}
+	id := getFileID(info)
+	if id == (fileID{}) || id == stream.fileID {
+		return false, nil
+	}
+	// A partial last line of the old file is complete now
+	if stream.lines != nil {
+		stream.lines.flush = true
+		_, err := stream.sendData()
+		stream.lines.flush = false
+		if err != nil {
+			return false, err
+		}
+	}
+	// All data of the old file must be acknowledged before switching
+	if err := stream.drainAcks(); err != nil {
+		log.Warn().Err(err).Str("stream", stream.streamID).Str("path", stream.filename).Int64("pos", stream.LastPos).Msg("Data of rotated input file not acknowledged, switching later")
+		return false, err
+	}
+	log.Info().Str("stream", stream.streamID).Str("path", stream.filename).Uint64("inode", id.Inode).Uint64("lastInode", stream.fileID.Inode).Int64("pos", stream.LastPos).Msg("Input file rotated, switching to new file")
+	metricInputRotationsTotal.Inc()
+	if stream.client != nil && stream.retireAfter > 0 {
+		// Only glob and directory inputs discover the drained file again
+		stream.client.addDrained(stream.fileID, stream.name)
+	}
+	stream.detached = false
+	stream.fpSum, stream.fpLen = 0, 0
+	if err := stream.OpenInputFile(0); err != nil {
+		return false, err
+	}
+	stream.LastRead = time.Now()
+	stream.saveState()
+	if stream.spool {
+		removeRotatedSpool(stream.filename)
+	}
+	// Initialize the stream again, so the server tracks the new file
+	stream.Disconnect()
+	if err := stream.Connect(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// checkTruncation detects an input file truncated in place (e.g. by logrotate
+// copytruncate), either by a size below the last position or by changed
+// content of the first bytes. The stream restarts at the beginning of the
+// file and is disconnected, so the truncation is reported on the next INIT.
+func (stream *ClientLogStream) checkTruncation() error {
+	info, err := stream.InputFile.Stat()
+	if err != nil {
+		return err
+	}
+	truncated := info.Size() < stream.LastPos
+	if !truncated && stream.fpLen > 0 {
+		sum, err := fingerprint(stream.InputFile, stream.fpLen)
+		if err != nil {
+			return err
+		}
+		truncated = sum != stream.fpSum
+	}
+	if !truncated {
+		return nil
+	}
+	log.Warn().Str("stream", stream.streamID).Str("path", stream.filename).Int64("pos", stream.LastPos).Int64("size", info.Size()).Msg("Input file truncated, restarting at beginning")
+	metricInputTruncationsTotal.Inc()
+	stream.truncated = stream.LastPos
+	stream.LastPos = 0
+	stream.committed = 0
+	stream.fpSum, stream.fpLen = 0, 0
+	if _, err := stream.InputFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	stream.resumeLines()
+	stream.saveState()
+	stream.Disconnect()
+	return errInputTruncated
+}
+
+// updateFingerprint extends the fingerprint of the input file with data
+// already sent, until fingerprintSize bytes are covered
+func (stream *ClientLogStream) updateFingerprint() {
+	if stream.fpLen >= fingerprintSize || stream.LastPos <= stream.fpLen {
+		return
+	}
+	size := stream.LastPos
+	if size > fingerprintSize {
+		size = fingerprintSize
+	}
+	sum, err := fingerprint(stream.InputFile, size)
+	if err != nil {
+		log.Warn().Err(err).Str("path", stream.filename).Msg("Failed to fingerprint input file")
+		return
+	}
+	stream.fpSum, stream.fpLen = sum, size
+}
+
+// rewind sets the position back to the data acknowledged by the server
+func (stream *ClientLogStream) rewind() {
+	if stream.LastPos == stream.committed {
+		return
+	}
+	log.Info().Str("stream", stream.streamID).Str("path", stream.filename).Int64("pos", stream.LastPos).Int64("committed", stream.committed).Msg("Rewinding to data acknowledged by server")
+	stream.LastPos = stream.committed
+	if stream.InputFile != nil {
+		if _, err := stream.InputFile.Seek(stream.LastPos, io.SeekStart); err != nil {
+			log.Error().Err(err).Str("path", stream.filename).Int64("pos", stream.LastPos).Msg("Failed to seek input file")
+		}
+	}
+	stream.resumeLines()
+}
+
+// resumeLines resets the line mode after the position changed
+func (stream *ClientLogStream) resumeLines() {
+	if stream.lines != nil {
+		stream.lines.resume(stream.InputFile, stream.LastPos)
+	}
+}
+
 // CloseInputFile will close the inputfile for this stream
 func (stream *ClientLogStream) CloseInputFile() {
 	if stream.InputFile != nil {
@@ -392,10 +1044,42 @@ func (stream *ClientLogStream) CloseInputFile() {
 // Close will close the stream
 func (stream *ClientLogStream) Close() {
 	stream.CloseInputFile()
-	if stream.conn != nil {
+	stream.Disconnect()
+}
+
+// drop closes the connection of the stream from outside of syncData, the
+// stream loop reconnects and resumes
+func (stream *ClientLogStream) drop() {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	stream.Disconnect()
+}
+
+// isConnected returns true if the stream is connected, from outside of
+// syncData
+func (stream *ClientLogStream) isConnected() bool {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	return stream.connected()
+}
+
+// Disconnect will close the connection of the stream, but keep the input
+// file open to resume at the committed position after reconnecting. Data
+// not acknowledged by the server is sent again.
+func (stream *ClientLogStream) Disconnect() {
+	if stream.connected() {
 		log.Info().Str("stream", stream.streamID).Msg("Closing stream")
-		stream.conn.Close()
-		stream.conn = nil
+		if stream.channel != nil {
+			stream.channel.close()
+			stream.channel = nil
+		} else {
+			stream.conn.Close()
+			stream.setConn(nil)
+		}
+		stream.commit()
+		stream.codec = nil
+		stream.acks = nil
+		stream.rewind()
 	} else {
 		log.Debug().Str("stream", stream.streamID).Msg("Stream already closed")
 	}
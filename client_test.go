@@ -0,0 +1,32 @@
+package loghamster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandleFileChangeSignalsStream(t *testing.T) {
+	client := NewClient("localhost:0", nil, nil)
+	stream := NewLogStream(client.server, "web1", "/var/log/app.log")
+	client.addStream(stream)
+	// A throttled send of the stream loop holds the lock
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	done := make(chan struct{})
+	go func() {
+		client.HandleFileChange(stream.filename)
+		client.HandleFileCreate(stream.filename)
+		client.HandleFileDelete(stream.filename)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("file watcher blocked by stream")
+	}
+	start := time.Now()
+	stream.waitChange(time.Minute)
+	if time.Since(start) > time.Second {
+		t.Error("stream loop not signaled")
+	}
+}
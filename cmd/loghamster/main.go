@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -20,6 +21,12 @@ import (
 
 var config loghamster.Configuration
 
+// Default directory of spool files of syslog, named pipe and stdin inputs
+const defaultSpoolDir = "/var/lib/loghamster/spool"
+
+// server is set in server mode to reopen its output files on signals
+var server *loghamster.Server
+
 func main() {
 
 	// Initialize logging using zerolog
@@ -32,8 +39,18 @@ func main() {
 
 	conf := &config
 
+	// The pipe command sends the data read from stdin, like
+	// some-job | loghamster pipe -name somejob
+	pipeMode := len(os.Args) > 1 && os.Args[1] == "pipe"
+	if pipeMode {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	// Define and parse commandline flags for initial configuration
 	configFile := flag.String("config", "loghamster.conf", "Configuration file to load")
+	pipeName := flag.String("name", "", "Input name of the data read from stdin by the pipe command")
+	pipeSpool := flag.String("spool", defaultSpoolDir, "Spool directory of the pipe command")
+	pipeWait := flag.Int("wait", 60, "Seconds the pipe command waits until the data read was sent")
 
 	flag.BoolVar(&conf.Debug, "debug", false, "Enable debug")
 	flag.BoolVar(&conf.Syslog.Enabled, "syslog", false, "Enable logging to syslog")
@@ -72,6 +89,10 @@ func main() {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	}
 
+	if pipeMode {
+		os.Exit(runPipe(conf, *pipeName, *pipeSpool, time.Duration(*pipeWait)*time.Second))
+	}
+
 	// Start CPU/memory profiling webserver if enabled
 	if conf.Profile.Enabled {
 		log.Info().Str("port", conf.Profile.Port).Msg("Starting CPU/memory profiling")
@@ -83,20 +104,94 @@ func main() {
 	// Process all file inputs
 	for _, f := range conf.Input {
 		log.Info().Str("path", f.Path).Msg("Add configured input file")
+		switch f.Type {
+		case "":
+		case loghamster.MethodFifo:
+			if f.Method != "" && f.Method != f.Type {
+				log.Fatal().Str("name", f.Name).Str("type", f.Type).Str("method", f.Method).Msg("Conflicting type and method of input")
+			}
+			f.Method = f.Type
+		default:
+			log.Fatal().Str("name", f.Name).Str("type", f.Type).Msg("Unknown type of input")
+		}
+		// Defaults are not applied to the list of inputs
+		if f.Method == "" {
+			f.Method = loghamster.MethodStream
+		}
+		if f.LongLines != "" && f.LongLines != loghamster.LongLinesSplit && f.LongLines != loghamster.LongLinesTruncate {
+			log.Fatal().Str("name", f.Name).Str("longLines", f.LongLines).Msg("Invalid handling of long lines for input")
+		}
+		if f.Method == loghamster.MethodSyslog {
+			if f.Name == "" || f.Listen == "" {
+				log.Fatal().Str("name", f.Name).Str("listen", f.Listen).Msg("Syslog input requires a name and an address to listen on")
+			}
+			if f.SourceBy != "" && f.SourceBy != loghamster.SourceByProgram && f.SourceBy != loghamster.SourceByFacility {
+				log.Fatal().Str("name", f.Name).Str("sourceBy", f.SourceBy).Msg("Invalid source of syslog input")
+			}
+		}
+		if f.Method == loghamster.MethodFifo && (f.Name == "" || f.Path == "") {
+			log.Fatal().Str("name", f.Name).Str("path", f.Path).Msg("Named pipe input requires a name and a path")
+		}
+		if f.SpoolDir == "" && (f.Method == loghamster.MethodSyslog || f.Method == loghamster.MethodFifo) {
+			f.SpoolDir = defaultSpoolDir
+		}
+		multiline, err := loghamster.NewMultiline(f.Multiline.Start, f.Multiline.Continue, f.Multiline.MaxLines, time.Duration(f.Multiline.Timeout)*time.Second)
+		if err != nil {
+			log.Fatal().Err(err).Str("name", f.Name).Msg("Invalid multiline configuration for input")
+		}
 		files.AddInput(loghamster.InputFile{
-			Name:  f.Name,
-			Path:  f.Path,
-			Watch: f.Watch,
+			Name:          f.Name,
+			Path:          f.Path,
+			Watch:         f.Watch,
+			Method:        f.Method,
+			Rotated:       f.Rotated,
+			AfterSend:     f.AfterSend,
+			ArchiveDir:    f.ArchiveDir,
+			Labels:        f.Labels,
+			RateLimit:     f.RateLimit,
+			RateBurst:     f.RateBurst,
+			Recursive:     f.Recursive,
+			MaxDepth:      f.MaxDepth,
+			Include:       f.Include,
+			Exclude:       f.Exclude,
+			RetireAfter:   time.Duration(f.RetireAfter) * time.Second,
+			Lines:         f.Lines,
+			LineTimeout:   time.Duration(f.LineTimeout) * time.Second,
+			MaxLineLength: f.MaxLineLength,
+			LongLines:     f.LongLines,
+			Multiline:     multiline,
+			Listen:        f.Listen,
+			SpoolDir:      f.SpoolDir,
+			SpoolSize:     f.SpoolSize,
+			SourceBy:      f.SourceBy,
+			BufferSize:    f.BufferSize,
+			MaxSpool:      f.MaxSpool,
 		})
 	}
 	// Process all file outputs
 	for _, f := range conf.Output {
 		log.Info().Str("path", f.Path).Msg("Add configured output file")
-		files.AddOutput(loghamster.OutputFile{
-			Name:     f.Name,
-			Path:     f.Path,
-			Compress: f.Compress,
+		err := files.AddOutput(loghamster.OutputFile{
+			Name:           f.Name,
+			Path:           f.Path,
+			Compress:       f.Compress,
+			CompressMethod: f.CompressMethod,
+			FlushInterval:  time.Duration(f.FlushInterval) * time.Second,
+			Host:           f.Host,
+			File:           f.File,
+			Input:          f.Input,
+			Labels:         f.Labels,
+			Rotate:         f.Rotate,
+			RotateSize:     f.RotateSize,
+			RotateInterval: f.RotateInterval,
+			RotateCompress: f.RotateCompress,
+			Format:         f.Format,
+			Timestamp:      f.Timestamp,
+			TimestampHost:  f.TimestampHost,
 		})
+		if err != nil {
+			log.Fatal().Err(err).Str("name", f.Name).Msg("Invalid output configuration")
+		}
 	}
 
 	// Setup syncronization of goroutines
@@ -104,7 +199,7 @@ func main() {
 	// Make the channel buffered to ensure no event is dropped. Notify will drop
 	// an event if the receiver is not able to keep up the sending pace.
 	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, os.Interrupt)
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
 
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -127,7 +222,7 @@ func main() {
 	}
 
 	if conf.Mode == "server" {
-		server, err := loghamster.NewServer(conf.Server.Listen, conf.Server.BaseDirectory, files)
+		server, err = loghamster.NewServer(conf.Server, files)
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to connect")
 		}
@@ -137,18 +232,47 @@ func main() {
 
 	} else {
 
-		client := loghamster.NewClient(conf.Target.Hostname+":"+strconv.Itoa(conf.Target.Port), files)
-		log.Info().Msgf("LogHamster client to server %s, creating streams", conf.Server)
+		client := newClient(conf, files)
+		log.Info().Msgf("LogHamster client to server %s:%d, creating streams", conf.Target.Hostname, conf.Target.Port)
+
+		client.WatchDir = watcher.Add
 
 		wg.Add(1)
 		go handleWatch(watcher, client)
 
 		for idx, file := range files.Inputs {
-			log.Debug().Msgf("Process stream #%d: %s", idx, file)
+			log.Debug().Msgf("Process stream #%d: %s", idx, file.Path)
 
 			name := file.Name
 			path := file.Path
 
+			if file.Method == loghamster.MethodSendAfterClose {
+				log.Info().Str("name", name).Str("rotated", file.Rotated).Msg("Send rotated files after close")
+				wg.Add(1)
+				go client.SendAfterClose(file)
+				continue
+			}
+			if file.Method == loghamster.MethodSyslog {
+				wg.Add(1)
+				go client.ListenSyslog(file)
+				continue
+			}
+			if file.Method == loghamster.MethodFifo {
+				wg.Add(1)
+				go client.ListenFifo(file)
+				continue
+			}
+			if file.Method != loghamster.MethodStream {
+				log.Error().Str("name", name).Str("method", file.Method).Msg("Unknown method for input, skipping")
+				continue
+			}
+			if file.IsPattern() {
+				// Streams are created for all files found now and later
+				wg.Add(1)
+				go client.Discover(file)
+				continue
+			}
+
 			// Set up a watch listening for filesystem notifications within the
 			// directory of the provided file
 			if file.Watch {
@@ -162,13 +286,13 @@ func main() {
 
 			log.Debug().Str("name", name).Str("path", path).Msg("Init stream")
 			// Should add watch now
-			s, err := client.NewLogStream(name, path)
+			s, err := client.NewLogStream(file, path)
 			if err != nil {
 				log.Error().Err(err).Str("name", name).Str("path", path).Msg("Failed to start stream")
 			}
 			log.Info().Str("name", name).Str("path", path).Msg("Starting stream")
 			wg.Add(1)
-			go s.StreamFile(path, 0)
+			go s.StreamFile(path, s.LastPos)
 			log.Debug().Str("name", name).Msg("Stream init succeeded")
 		}
 	}
@@ -186,6 +310,65 @@ func main() {
 	quit(0)
 }
 
+// newClient returns a client for the target server of the configuration,
+// resuming the streams at the checkpoints of its state file
+func newClient(conf *loghamster.Configuration, files *loghamster.FileManager) *loghamster.Client {
+	state := loghamster.NewStateFile(conf.Target.StateFile)
+	if err := state.Load(); err != nil {
+		log.Error().Err(err).Str("statefile", conf.Target.StateFile).Msg("Failed to load state file, starting without checkpoints")
+	}
+	client := loghamster.NewClient(conf.Target.Hostname+":"+strconv.Itoa(conf.Target.Port), files, state)
+	if conf.Target.Source != "" {
+		client.Hostname = conf.Target.Source
+	}
+	if conf.Target.Compress {
+		client.Compress = conf.Target.CompressMethod
+	}
+	if conf.Target.TLS.Enabled {
+		tlsConfig, err := loghamster.NewClientTLSConfig(conf.Target.TLS)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to setup TLS")
+		}
+		client.TLS = tlsConfig
+	}
+	auth, err := loghamster.LoadCredentials(conf.Target.TokenID, conf.Target.TokenFile, client.Hostname)
+	if err != nil {
+		log.Fatal().Err(err).Str("tokenfile", conf.Target.TokenFile).Msg("Failed to load token")
+	}
+	client.Auth = auth
+	if conf.Target.AckWindow > 0 {
+		client.Window = conf.Target.AckWindow
+	}
+	client.SetRateLimit(conf.Target.RateLimit, conf.Target.RateBurst)
+	client.Multiplex = conf.Target.Multiplex
+	return client
+}
+
+// runPipe sends the data read from stdin as the input of the name and
+// returns the exit code of the pipe command
+func runPipe(conf *loghamster.Configuration, name string, spoolDir string, wait time.Duration) int {
+	if name == "" || conf.Target.Hostname == "" {
+		log.Error().Str("name", name).Msg("Pipe command requires a name and a target server")
+		return 2
+	}
+	// Checkpoints of the pipe are kept apart from the client service
+	conf.Target.StateFile = filepath.Join(spoolDir, name+".state")
+	client := newClient(conf, loghamster.NewFileManager())
+	if watcher, err := fsnotify.NewWatcher(); err == nil {
+		defer watcher.Close()
+		client.WatchDir = watcher.Add
+		go handleWatch(watcher, client)
+	}
+	log.Info().Str("name", name).Str("spooldir", spoolDir).Msg("Sending data read from stdin")
+	input := loghamster.InputFile{Name: name, SpoolDir: spoolDir}
+	if err := client.ReadPipe(input, os.Stdin, wait); err != nil {
+		log.Error().Err(err).Str("name", name).Msg("Failed to send data read from stdin")
+		return 1
+	}
+	log.Info().Str("name", name).Msg("Sent data read from stdin")
+	return 0
+}
+
 func quit(code int) {
 	log.Info().Msg("Done.")
 	os.Exit(code)
@@ -194,9 +377,19 @@ func quit(code int) {
 func handleSignal(ch <-chan os.Signal) {
 	for sig := range ch {
 		switch sig {
-		case os.Interrupt:
-			log.Info().Str("signal", sig.String()).Msg("Ignoring interrupt signal")
+		case os.Interrupt, syscall.SIGTERM:
+			log.Info().Str("signal", sig.String()).Msg("Shutting down on signal")
+			if server != nil {
+				server.Close()
+			}
 			quit(0)
+		case syscall.SIGHUP, syscall.SIGUSR1:
+			if server == nil {
+				log.Info().Str("signal", sig.String()).Msg("Ignoring signal, no output files to reopen")
+				continue
+			}
+			log.Info().Str("signal", sig.String()).Msg("Reopening output files")
+			server.ReopenOutputs()
 		default:
 			log.Info().Str("signal", sig.String()).Msg("Ignoring unhandled signal")
 		}
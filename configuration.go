@@ -15,31 +15,146 @@ type Configuration struct {
 
 // ServerConfig for settings of a loghamster in server/receiver mode
 type ServerConfig struct {
-	Listen        string `default:":7007"`
-	BaseDirectory string `default:"/var/log/loghamster"`
-	PathTemplate  string `default:"$HOST/$FILE"`
+	Listen        string   `default:":7007"`
+	BaseDirectory string   `default:"/var/log/loghamster"`
+	PathTemplate  string   `default:"$HOST/$FILE"`
+	Strict        bool     // Reject streams not matching any configured output
+	AckSync       bool     // Sync output files to disk before acknowledging data
+	StateFile     string   `default:"/var/lib/loghamster/server.state"` // Offsets held per source, empty to disable
+	MetricLabels  []string // Metadata keys of streams added as labels to stream metrics
+
+	// Compression and format of outputs using the path template
+	Compress       bool
+	CompressMethod string `default:"gzip"` // "gzip" or "zstd"
+	Format         string `default:"raw"`  // "raw" or "jsonl" with a JSON object per line
+	Timestamp      string // Prefix lines of raw outputs with the receive time in the layout, like "RFC3339Nano"
+	TimestampHost  bool   // Prefix lines with the host after the receive time
+
+	// Receive syslog messages, like forwarded by rsyslog, written by host and program
+	Syslog     []string // Addresses like "udp://0.0.0.0:514", "tcp://0.0.0.0:601" or "tls://0.0.0.0:6514"
+	SyslogName string   `default:"syslog"` // Input name of syslog sources, their files are <name>/<program>
+
+	TLS  TLSConfig
+	Auth AuthConfig
 }
 
 // TargetConfig for settings of a loghamster in client/sender mode
 type TargetConfig struct {
-	Hostname string
-	Port     int  `default:"7007"`
-	Compress bool `default:"true"`
+	Hostname       string
+	Port           int    `default:"7007"`
+	Compress       bool   `default:"true"`
+	CompressMethod string `default:"gzip"` // Compression of stream data: "gzip", "zstd" or "snappy"
+	Source         string // Hostname of this client sent to the server, defaults to the local hostname
+	StateFile      string `default:"/var/lib/loghamster/client.state"` // Checkpoints of all streams, empty to disable
+	AckWindow      int    `default:"16"`                               // Maximum number of data chunks sent without acknowledgement
+	TokenID        string // ID of the token to authenticate with, defaults to the source hostname
+	TokenFile      string // File with the token secret, overridden by the LOGHAMSTER_TOKEN environment variable
+	RateLimit      int    // Bandwidth limit of all streams in bytes per second, 0 for unlimited
+	RateBurst      int    // Bytes sent at once above the limit, defaults to the limit
+	Multiplex      bool   // Send all streams within a session over a single connection
+
+	TLS TLSConfig
+}
+
+// TLSConfig holds the certificates for encrypted connections
+type TLSConfig struct {
+	Enabled    bool
+	Cert       string // PEM encoded certificate, required for the server
+	Key        string // PEM encoded private key of the certificate
+	CA         string // PEM encoded CA bundle to verify the peer certificate
+	MinVersion string `default:"1.2"` // Minimum TLS version: "1.0", "1.1", "1.2" or "1.3"
+
+	// Server only: require a client certificate signed by the CA
+	RequireClientCert bool
+	// Server only: hostnames a client certificate may claim, by common name or
+	// DNS name of the certificate. Matched exactly, by glob or by regex (~) of the whole hostname.
+	Hosts map[string][]string
+
+	// Client only: name to verify the server certificate, defaults to the target hostname
+	ServerName string
+}
+
+// AuthConfig holds the tokens clients authenticate with
+type AuthConfig struct {
+	Enabled bool // Require authentication of all clients
+	Token   []authToken
+}
+
+type authToken struct {
+	ID        string
+	Token     string   // Shared secret of the token
+	TokenFile string   // File with the shared secret
+	Hosts     []string // Hostnames the token may claim, defaults to the ID. Matched exactly, by glob or by regex (~) of the whole hostname.
 }
 
 // Stream holds the files to stream
 type fileInput struct {
-	Name  string
-	Path  string
-	Watch bool
+	Name       string
+	Path       string
+	Watch      bool
+	Method     string            // "stream" (default), "send-after-close", "syslog" or "fifo"
+	Type       string            // "fifo" for a named pipe, same as method "fifo"
+	Rotated    string            // Glob of rotated files for send-after-close, e.g. /var/log/app.log.*
+	AfterSend  string            // "keep" (default), "delete" or "archive" after the server confirmed a file
+	ArchiveDir string            // Directory to move sent files to for "archive"
+	Labels     map[string]string // Metadata sent to the server, like { svc = "sipproxyd" }
+	RateLimit  int               // Bandwidth limit of the input in bytes per second, 0 for unlimited
+	RateBurst  int               // Bytes sent at once above the limit, defaults to the limit
+
+	// Glob and directory inputs: path is a glob pattern like /var/log/app/*.log
+	// or a directory, a stream is created for each file found
+	Recursive   bool     // Include files in subdirectories of a directory
+	MaxDepth    int      // Levels of subdirectories, 0 for unlimited
+	Include     []string // Glob patterns of file names to include, like "*.log"
+	Exclude     []string // Glob patterns of file names to exclude, like "*.gz"
+	RetireAfter int      // Seconds to keep streams of vanished files, defaults to 300
+
+	// Line mode: only complete lines are sent, so records are never split
+	Lines         bool   // Hold back a partial line until it is completed
+	LineTimeout   int    // Seconds a partial line is held back before it is sent, defaults to 5
+	MaxLineLength int    // Lines longer than the bytes are split or truncated, defaults to 32768
+	LongLines     string // "split" (default) or "truncate" long lines, marked with " [...]"
+
+	// Group lines into records, like stack traces, implies line mode
+	Multiline multilineInput
+
+	// Syslog listener: messages are spooled and streamed by program or facility,
+	// spool settings apply to named pipes as well
+	Listen    string // Address like "udp://0.0.0.0:514", "tcp://127.0.0.1:601" or "unix:///dev/log"
+	SpoolDir  string // Directory of spool files, defaults to /var/lib/loghamster/spool
+	SpoolSize string // Rotate spool files once sent and larger than the size, defaults to 16M
+	MaxSpool  string // Drop data once the spool files of a source hold the size, defaults to 1G
+	SourceBy  string // "program" (default) or "facility" as logical file name
+
+	// Named pipe: path is created as fifo, data written to it is spooled
+	BufferSize string // Data held in memory while the spool is full, defaults to 1M
+}
+
+// multilineInput defines how lines of an input are grouped into records
+type multilineInput struct {
+	Start    string // Regex matching the first line of a record
+	Continue string // Regex matching continuation lines of a record, instead of start
+	MaxLines int    // Lines of a record, defaults to 500
+	Timeout  int    // Seconds to wait for more lines of the last record, defaults to the line timeout
 }
 
 type fileOutput struct {
 	Name           string
 	Path           string
+	Host           string            // Match hostname exactly, by glob or by regex (prefixed with ~)
+	File           string            // Match file path of the stream
+	Input          string            // Match input name of the stream
+	Labels         map[string]string // Match metadata of the stream by key
 	Compress       bool
-	CompressMethod string
-	Rotate         int
+	CompressMethod string // "gzip" (default) or "zstd"
+	FlushInterval  int    // Seconds between flush points of compressed data, defaults to 10
+	Rotate         int    // Number of rotated files kept, rotates daily without size or interval
+	RotateSize     string // Rotate once the file reached the size, like "100M"
+	RotateInterval string // Rotate "hourly" or "daily"
+	RotateCompress bool   // Compress rotated files of uncompressed outputs
+	Format         string // "raw" (default) or "jsonl" with a JSON object per line or record
+	Timestamp      string // Prefix lines of raw outputs with the receive time in the layout, like "RFC3339Nano"
+	TimestampHost  bool   // Prefix lines with the host after the receive time
 }
 
 // PrometheusConfig holds configuration for a Prometheus /metrics endpoint
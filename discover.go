@@ -0,0 +1,314 @@
+package loghamster
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// rotatedName matches names of files rotated by logrotate, like app.log.1,
+// app.log.2.gz or app.log-20240101
+var rotatedName = regexp.MustCompile(`(\.[0-9]+|-[0-9]{8}(-[0-9]+)?)(\.(gz|bz2|xz|zst|lz4))?$`)
+
+const (
+	// Interval to look for new files of glob and directory inputs
+	discoverInterval = 10 * time.Second
+	// Default time a stream of a vanished file is kept before it is retired
+	defaultRetireAfter = 5 * time.Minute
+)
+
+// IsPattern returns true if the input discovers its files by a glob
+// pattern or within a directory instead of a single path
+func (input *InputFile) IsPattern() bool {
+	return input.directory || strings.ContainsAny(input.Path, "*?[")
+}
+
+// Matches returns true if the file path belongs to the input
+func (input *InputFile) Matches(path string) bool {
+	path = filepath.Clean(path)
+	if !input.IsPattern() {
+		return path == filepath.Clean(input.Path)
+	}
+	rel := filepath.Base(path)
+	if input.directory {
+		var err error
+		rel, err = filepath.Rel(filepath.Clean(input.Path), path)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return false
+		}
+		depth := strings.Count(rel, string(filepath.Separator))
+		if depth > 0 && !input.Recursive {
+			return false
+		}
+		if input.MaxDepth > 0 && depth > input.MaxDepth {
+			return false
+		}
+	} else if matched, _ := filepath.Match(input.Path, path); !matched {
+		return false
+	}
+	for _, pattern := range input.Exclude {
+		if matchName(pattern, path, rel) {
+			return false
+		}
+	}
+	if len(input.Include) == 0 {
+		// Rotated files are drained by the stream of the file before rotation
+		return !rotatedName.MatchString(filepath.Base(path))
+	}
+	for _, pattern := range input.Include {
+		if matchName(pattern, path, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchName matches the pattern against the base name of the file, or
+// against the path relative to the input if the pattern contains a slash
+func matchName(pattern string, path string, rel string) bool {
+	name := filepath.Base(path)
+	if strings.Contains(pattern, "/") {
+		name = rel
+	}
+	matched, _ := filepath.Match(pattern, name)
+	return matched
+}
+
+// discover returns all existing files of the input and the directories
+// to watch for new files
+func (input *InputFile) discover() ([]string, []string) {
+	var files, dirs []string
+	if !input.directory {
+		paths, err := filepath.Glob(input.Path)
+		if err != nil {
+			log.Error().Err(err).Str("path", input.Path).Msg("Invalid pattern for input")
+			return nil, nil
+		}
+		seen := map[string]bool{}
+		for _, path := range paths {
+			if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && input.Matches(path) {
+				files = append(files, path)
+			}
+			if dir := filepath.Dir(path); !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
+			}
+		}
+		if dir := filepath.Dir(input.Path); !strings.ContainsAny(dir, "*?[") && !seen[dir] {
+			dirs = append(dirs, dir)
+		}
+		return files, dirs
+	}
+	root := filepath.Clean(input.Path)
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Debug().Err(err).Str("path", path).Msg("Unable to read path of directory input")
+			return nil
+		}
+		if info.IsDir() {
+			if path != root {
+				depth := strings.Count(strings.TrimPrefix(path, root+string(filepath.Separator)), string(filepath.Separator)) + 1
+				if !input.Recursive || (input.MaxDepth > 0 && depth > input.MaxDepth) {
+					return filepath.SkipDir
+				}
+			}
+			dirs = append(dirs, path)
+			return nil
+		}
+		if info.Mode().IsRegular() && input.Matches(path) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, dirs
+}
+
+// Discover looks for files of a glob or directory input and starts a
+// stream for each new file. Directories are watched for new files using
+// WatchDir, if the input is watched.
+func (client *Client) Discover(input InputFile) {
+	log.Info().Str("name", input.Name).Str("path", input.Path).Bool("recursive", input.Recursive).Msg("Discovering files of input")
+	watched := map[string]bool{}
+	for {
+		files, dirs := input.discover()
+		if input.Watch && client.WatchDir != nil {
+			for _, dir := range dirs {
+				if watched[dir] {
+					continue
+				}
+				if err := client.WatchDir(dir); err != nil {
+					log.Error().Err(err).Str("dir", dir).Msg("Failed to watch dir of input")
+					continue
+				}
+				log.Debug().Str("dir", dir).Str("name", input.Name).Msg("Watching dir of input for new files")
+				watched[dir] = true
+			}
+		}
+		known := client.knownFiles()
+		seen := map[fileID]bool{}
+		for _, path := range files {
+			id := pathFileID(path)
+			seen[id] = true
+			if client.FindStreamByPath(path) == nil && !known.has(id, path) {
+				log.Info().Str("name", input.Name).Str("path", path).Msg("Discovered new file of input")
+				client.StartStream(input, path)
+			}
+		}
+		client.pruneDrained(input.Name, seen)
+		time.Sleep(discoverInterval)
+	}
+}
+
+// StartStream creates a stream for the file of the input and follows the
+// file in the background, unless a stream for the file exists already
+func (client *Client) StartStream(input InputFile, path string) *ClientLogStream {
+	return client.startStream(input, path, "")
+}
+
+// startStream creates and follows a stream for the file of the input, sent
+// to the server as the logical file name of the source if set
+func (client *Client) startStream(input InputFile, path string, source string) *ClientLogStream {
+	client.startMutex.Lock()
+	defer client.startMutex.Unlock()
+	if stream := client.FindStreamByPath(path); stream != nil {
+		return stream
+	}
+	if input.IsPattern() && client.isKnownFile(path) {
+		log.Debug().Str("name", input.Name).Str("path", path).Msg("File of input already streamed under another path, skipping it")
+		return nil
+	}
+	stream, err := client.newLogStream(input, path, source)
+	if err != nil {
+		log.Error().Err(err).Str("name", input.Name).Str("path", path).Msg("Failed to start stream")
+		return nil
+	}
+	if input.IsPattern() {
+		stream.retireAfter = input.RetireAfter
+		if stream.retireAfter <= 0 {
+			stream.retireAfter = defaultRetireAfter
+		}
+	}
+	go stream.StreamFile(path, stream.LastPos)
+	return stream
+}
+
+// knownFiles maps the files (by device/inode) streamed, drained by a
+// stream after a rotation or checkpointed to the path they are known by.
+// Streamed and drained files are known by any path.
+type knownFiles map[fileID]string
+
+// has returns true if the file is known by another path, like a file
+// renamed by logrotate, or is streamed or drained
+func (known knownFiles) has(id fileID, path string) bool {
+	if id == (fileID{}) {
+		return false
+	}
+	knownPath, ok := known[id]
+	return ok && knownPath != path
+}
+
+// knownFiles indexes the files known to the client, once per discovery
+// pass instead of scanning all checkpoints for each file
+func (client *Client) knownFiles() knownFiles {
+	known := knownFiles{}
+	for _, checkpoint := range client.state.All() {
+		id := fileID{Device: checkpoint.Device, Inode: checkpoint.Inode}
+		if path, ok := known[id]; ok && path != checkpoint.Path {
+			// Checkpointed by several paths, so known by any path
+			known[id] = ""
+		} else if checkpoint.Inode != 0 {
+			known[id] = checkpoint.Path
+		}
+	}
+	client.mutex.Lock()
+	streams := append([]*ClientLogStream{}, client.streams...)
+	for id := range client.drained {
+		known[id] = ""
+	}
+	client.mutex.Unlock()
+	for _, stream := range streams {
+		stream.mutex.Lock()
+		if stream.fileID != (fileID{}) {
+			known[stream.fileID] = ""
+		}
+		stream.mutex.Unlock()
+	}
+	return known
+}
+
+// isKnownFile returns true if the file (by device/inode) is streamed, was
+// drained by a stream after a rotation or has a checkpoint under another
+// path, like a file renamed by logrotate
+func (client *Client) isKnownFile(path string) bool {
+	return client.knownFiles().has(pathFileID(path), path)
+}
+
+// pathFileID returns the device/inode of the file at the path, zero if
+// unknown
+func pathFileID(path string) fileID {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileID{}
+	}
+	return getFileID(info)
+}
+
+// addDrained records a file drained by a stream of the input after a
+// rotation
+func (client *Client) addDrained(id fileID, input string) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.drained == nil {
+		client.drained = map[fileID]string{}
+	}
+	client.drained[id] = input
+}
+
+// pruneDrained forgets the drained files of the input not found by the
+// discovery pass anymore, like rotated files removed or compressed since
+func (client *Client) pruneDrained(input string, seen map[fileID]bool) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	for id, name := range client.drained {
+		if name == input && !seen[id] {
+			delete(client.drained, id)
+		}
+	}
+}
+
+// retireDue returns true if the input file vanished and the stream was
+// idle for the grace period, so it can be retired
+func (stream *ClientLogStream) retireDue() bool {
+	if stream.retireAfter <= 0 || time.Since(stream.LastRead) < stream.retireAfter {
+		return false
+	}
+	if _, err := os.Stat(stream.filename); !os.IsNotExist(err) {
+		return false
+	}
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	return stream.detached || stream.InputFile == nil
+}
+
+// retire drains the stream of a vanished file, closes it and removes it
+// from the client and the state file
+func (stream *ClientLogStream) retire() {
+	stream.mutex.Lock()
+	if err := stream.drainAcks(); err != nil {
+		log.Warn().Err(err).Str("stream", stream.streamID).Str("path", stream.filename).Msg("Retiring stream with data not acknowledged")
+	}
+	stream.Close()
+	stream.mutex.Unlock()
+	if stream.client != nil {
+		stream.client.removeStream(stream)
+	}
+	if stream.state != nil {
+		stream.state.Remove(stream.filename)
+	}
+	metricStreamsRetiredTotal.Inc()
+	log.Info().Str("stream", stream.streamID).Str("path", stream.filename).Dur("idle", time.Since(stream.LastRead)).Msg("Retired stream of vanished file")
+}
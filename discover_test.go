@@ -0,0 +1,41 @@
+package loghamster
+
+import "testing"
+
+func TestKnownFiles(t *testing.T) {
+	client := NewClient("localhost:0", nil, nil)
+	client.state.Set(StreamState{Path: "/log/a.log", Device: 1, Inode: 10})
+	client.state.Set(StreamState{Path: "/log/b.log", Device: 1, Inode: 20})
+	client.state.Set(StreamState{Path: "/log/c.log", Device: 1, Inode: 20})
+	client.state.Set(StreamState{Path: "/log/new.log"})
+	client.addDrained(fileID{Device: 1, Inode: 30}, "logs")
+	known := client.knownFiles()
+	tests := []struct {
+		id   fileID
+		path string
+		want bool
+	}{
+		{fileID{Device: 1, Inode: 10}, "/log/a.log", false},
+		{fileID{Device: 1, Inode: 10}, "/log/a.log.1", true},
+		{fileID{Device: 1, Inode: 20}, "/log/b.log", true},
+		{fileID{Device: 1, Inode: 30}, "/log/d.log", true},
+		{fileID{Device: 1, Inode: 40}, "/log/new.log", false},
+		{fileID{}, "/log/x.log", false},
+	}
+	for _, test := range tests {
+		if got := known.has(test.id, test.path); got != test.want {
+			t.Errorf("%v %s: got %v, want %v", test.id, test.path, got, test.want)
+		}
+	}
+}
+
+func TestPruneDrained(t *testing.T) {
+	client := NewClient("localhost:0", nil, nil)
+	client.addDrained(fileID{Device: 1, Inode: 1}, "logs")
+	client.addDrained(fileID{Device: 1, Inode: 2}, "logs")
+	client.addDrained(fileID{Device: 1, Inode: 3}, "other")
+	client.pruneDrained("logs", map[fileID]bool{{Device: 1, Inode: 1}: true})
+	if len(client.drained) != 2 || client.drained[fileID{Device: 1, Inode: 1}] != "logs" || client.drained[fileID{Device: 1, Inode: 3}] != "other" {
+		t.Errorf("got %v after pruning", client.drained)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package loghamster
+
+import "syscall"
+
+// mkfifo creates a named pipe
+func mkfifo(path string) error {
+	return syscall.Mkfifo(path, 0660)
+}
@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package loghamster
+
+import "errors"
+
+// mkfifo is not supported on windows
+func mkfifo(path string) error {
+	return errors.New("named pipes not supported on windows")
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package loghamster
+
+import (
+	"os"
+	"syscall"
+)
+
+// getFileID returns the device and inode of a file
+func getFileID(info os.FileInfo) fileID {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return fileID{Device: uint64(stat.Dev), Inode: uint64(stat.Ino)}
+	}
+	return fileID{}
+}
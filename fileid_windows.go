@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package loghamster
+
+import "os"
+
+// getFileID is not supported on windows, files are identified by path only
+func getFileID(info os.FileInfo) fileID {
+	return fileID{}
+}
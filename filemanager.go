@@ -1,21 +1,120 @@
 package loghamster
 
-import "os"
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
 
 // InputFile is a file reader for files in the filesystem
 type InputFile struct {
-	Name  string // A logical name for a file (like authlog)
-	Path  string
-	Watch bool
-	file  *os.File
+	Name          string // A logical name for a file (like authlog)
+	Path          string
+	Watch         bool
+	Method        string // MethodStream or MethodSendAfterClose
+	Rotated       string // Glob matching rotated files to send after close
+	AfterSend     string // Action after a file was sent (keep, delete, archive)
+	ArchiveDir    string
+	Labels        map[string]string // Metadata sent to the server on INIT
+	RateLimit     int               // Bandwidth limit in bytes per second, 0 for unlimited
+	RateBurst     int               // Bytes sent at once above the limit, defaults to the limit
+	Recursive     bool              // Include files in subdirectories of a directory input
+	MaxDepth      int               // Levels of subdirectories of a recursive input, 0 for unlimited
+	Include       []string          // Glob patterns of file names to include, all files by default
+	Exclude       []string          // Glob patterns of file names to exclude
+	RetireAfter   time.Duration     // Grace period before streams of vanished files are retired
+	Lines         bool              // Send complete lines only, holding back a partial line
+	LineTimeout   time.Duration     // Time a partial line is held back before it is sent
+	MaxLineLength int               // Lines are split or truncated at the length in bytes
+	LongLines     string            // LongLinesSplit or LongLinesTruncate
+	Multiline     *Multiline        // Group lines into records, implies line mode
+	Listen        string            // Address of the syslog listener, like udp://127.0.0.1:514
+	SpoolDir      string            // Directory of the spool files of received messages
+	SpoolSize     string            // Rotate spool files once sent and larger than the size, like 16M
+	SourceBy      string            // SourceByProgram or SourceByFacility
+	BufferSize    string            // Data of pipes held in memory while the spool is full, like 1M
+	MaxSpool      string            // Data of pipes is dropped once the spool files hold the size, like 1G
+	limiter       *rate.Limiter     // Shared by all streams of the input
+	directory     bool              // Path is a directory to discover files in
+	file          *os.File
 }
 
 // OutputFile is a file reader for files in the filesystem
 type OutputFile struct {
-	Name     string // A logical name for a file (like authlog)
-	Path     string
-	Compress bool
-	file     *os.File
+	Name           string // A logical name for a file (like authlog)
+	Path           string // Path template, relative paths are below the base directory
+	Compress       bool
+	CompressMethod string            // CompressGzip or CompressZstd
+	FlushInterval  time.Duration     // Interval between flush points of compressed data
+	Host           string            // Pattern to match the hostname of a stream
+	File           string            // Pattern to match the file path of a stream
+	Input          string            // Pattern to match the input name of a stream
+	Labels         map[string]string // Patterns to match metadata of a stream by key
+	Rotate         int               // Number of rotated files kept, 0 keeps all
+	RotateSize     string            // Rotate once the file reached the size, like 100M
+	RotateInterval string            // Rotate RotateHourly or RotateDaily
+	RotateCompress bool              // Compress rotated files of uncompressed outputs
+	Format         string            // FormatRaw or FormatJSONL, defaults to the format of the server
+	Timestamp      string            // Layout of the receive time prefixed to lines, defaults to the server
+	TimestampHost  bool              // Prefix lines with the host after the receive time
+	file           *os.File
+	matchers       []outputMatcher
+	rotation       rotatePolicy
+}
+
+// outputMatcher matches a single stream attribute against a pattern
+type outputMatcher struct {
+	attribute string
+	pattern   *pattern
+}
+
+// pattern matches a value exactly, by glob (if it contains *, ? or [) or
+// by a regular expression (if prefixed with ~)
+type pattern struct {
+	raw    string
+	glob   bool
+	regexp *regexp.Regexp
+}
+
+// newPattern will parse the pattern, an empty pattern returns nil
+func newPattern(raw string) (*pattern, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	p := pattern{raw: raw}
+	if strings.HasPrefix(raw, "~") {
+		re, err := regexp.Compile(raw[1:])
+		if err != nil {
+			return nil, err
+		}
+		p.regexp = re
+	} else if strings.ContainsAny(raw, "*?[") {
+		if _, err := filepath.Match(raw, ""); err != nil {
+			return nil, err
+		}
+		p.glob = true
+	}
+	return &p, nil
+}
+
+// Match will return true if the value matches the pattern
+func (p *pattern) Match(value string) bool {
+	if p.regexp != nil {
+		return p.regexp.MatchString(value)
+	}
+	if p.glob {
+		matched, _ := filepath.Match(p.raw, value)
+		return matched
+	}
+	return p.raw == value
 }
 
 // NewInputFile will initialize a logfile input
@@ -30,6 +129,9 @@ func (f InputFile) Open() error {
 	return err
 }
 
+// Number of bytes at the beginning of a file used to fingerprint it
+const fingerprintSize int64 = 1024
+
 // FileManager holds all configured input and outputs
 type FileManager struct {
 	Inputs  []InputFile
@@ -44,12 +146,48 @@ func NewFileManager() *FileManager {
 
 // AddInput adds a new file input to the stream manager
 func (mgr *FileManager) AddInput(input InputFile) {
+	input.limiter = newRateLimiter(input.RateLimit, input.RateBurst)
+	if info, err := os.Stat(input.Path); input.Recursive || strings.HasSuffix(input.Path, string(filepath.Separator)) || (err == nil && info.IsDir()) {
+		input.directory = true
+	}
 	mgr.Inputs = append(mgr.Inputs, input)
 }
 
-// AddOutput adds a new file input to the stream manager
-func (mgr *FileManager) AddOutput(output OutputFile) {
+// AddOutput adds a new file output to the stream manager, the patterns
+// for host, file and input are compiled to match streams
+func (mgr *FileManager) AddOutput(output OutputFile) error {
+	rotation, err := newRotatePolicy(output.Rotate, output.RotateSize, output.RotateInterval, output.RotateCompress, output.CompressMethod)
+	if err != nil {
+		return fmt.Errorf("invalid rotation for output %s: %v", output.Name, err)
+	}
+	output.rotation = rotation
+	if !isFormat(output.Format) {
+		return fmt.Errorf("unknown format %s for output %s", output.Format, output.Name)
+	}
+	if output.Compress {
+		if output.CompressMethod == "" {
+			output.CompressMethod = CompressGzip
+		}
+		if compressExtension(output.CompressMethod) == "" {
+			return fmt.Errorf("unknown compression method %s for output %s", output.CompressMethod, output.Name)
+		}
+	}
+	output.matchers = nil
+	rules := []struct{ attribute, raw string }{{"host", output.Host}, {"file", output.File}, {"input", output.Input}}
+	for key, raw := range output.Labels {
+		rules = append(rules, struct{ attribute, raw string }{"meta:" + key, raw})
+	}
+	for _, rule := range rules {
+		p, err := newPattern(rule.raw)
+		if err != nil {
+			return fmt.Errorf("invalid %s pattern for output %s: %v", rule.attribute, output.Name, err)
+		}
+		if p != nil {
+			output.matchers = append(output.matchers, outputMatcher{rule.attribute, p})
+		}
+	}
 	mgr.Outputs = append(mgr.Outputs, output)
+	return nil
 }
 
 // FindInputByName will return an InputFile if found by name
@@ -63,17 +201,28 @@ func (mgr *FileManager) FindInputByName(name string) *InputFile {
 	return nil
 }
 
-// FindInputByPath will return an InputFile if found by path
-// otherwise nil
+// FindInputByPath will return an InputFile if found by path, or the
+// first glob or directory input matching the path, otherwise nil
 func (mgr *FileManager) FindInputByPath(path string) *InputFile {
 	for _, file := range mgr.Inputs {
 		if file.Path == path {
 			return &file
 		}
 	}
+	for _, file := range mgr.Inputs {
+		if file.IsPattern() && file.Matches(path) {
+			return &file
+		}
+	}
 	return nil
 }
 
+// isRegularFile returns true if the path refers to a regular file
+func isRegularFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
 // FindOutputByName will return an InputFile if found by name
 // otherwise nil
 func (mgr *FileManager) FindOutputByName(name string) *OutputFile {
@@ -85,6 +234,37 @@ func (mgr *FileManager) FindOutputByName(name string) *OutputFile {
 	return nil
 }
 
+// FindOutput will return the first output matching the stream by host,
+// file path, input name and metadata, otherwise nil. An output without
+// rules matches streams with an input name equal to the output name.
+func (mgr *FileManager) FindOutput(host string, file string, meta map[string]string) *OutputFile {
+	input := meta["name"]
+	values := map[string]string{"host": host, "file": file, "input": input}
+	for key, value := range meta {
+		values["meta:"+key] = value
+	}
+	for i := range mgr.Outputs {
+		output := &mgr.Outputs[i]
+		if len(output.matchers) == 0 {
+			if output.Name != "" && output.Name == input {
+				return output
+			}
+			continue
+		}
+		matched := true
+		for _, m := range output.matchers {
+			if !m.pattern.Match(values[m.attribute]) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return output
+		}
+	}
+	return nil
+}
+
 // FindOutputByPath will return an OutputFile if found by path
 // otherwise nil
 func (mgr *FileManager) FindOutputByPath(path string) *OutputFile {
@@ -95,3 +275,36 @@ func (mgr *FileManager) FindOutputByPath(path string) *OutputFile {
 	}
 	return nil
 }
+
+// fileID identifies a file independent of its name by device and inode
+type fileID struct {
+	Device uint64
+	Inode  uint64
+}
+
+// findFileByID will return the path of the file within dir having the
+// given device/inode, e.g. to find an input file after it was rotated.
+// An empty string is returned if no such file exists.
+func findFileByID(dir string, id fileID) string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, info := range entries {
+		if info.Mode().IsRegular() && getFileID(info) == id {
+			return filepath.Join(dir, info.Name())
+		}
+	}
+	return ""
+}
+
+// fingerprint will return a checksum of the first size bytes of the file,
+// without changing the current read position
+func fingerprint(file *os.File, size int64) (uint32, error) {
+	buf := make([]byte, size)
+	n, err := file.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(buf[:n]), nil
+}
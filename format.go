@@ -0,0 +1,180 @@
+package loghamster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Formats of output files
+const (
+	FormatRaw   = "raw"   // Data as sent by the client
+	FormatJSONL = "jsonl" // A JSON object with metadata per line or record
+)
+
+// Named layouts of the receive time prefixed to lines of raw outputs,
+// other layouts are used as Go time layouts
+var timestampLayouts = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+	"stamp":       time.Stamp,
+	"stampmilli":  time.StampMilli,
+	"stampmicro":  time.StampMicro,
+	"datetime":    "2006-01-02 15:04:05.000000",
+}
+
+// timestampLayout returns the time layout of a named or Go layout
+func timestampLayout(layout string) string {
+	if named, ok := timestampLayouts[strings.ToLower(layout)]; ok {
+		return named
+	}
+	return layout
+}
+
+// isFormat returns true if the output format is supported
+func isFormat(format string) bool {
+	switch format {
+	case "", FormatRaw, FormatJSONL:
+		return true
+	}
+	return false
+}
+
+// jsonRecord is the envelope of a line or record in jsonl outputs
+type jsonRecord struct {
+	Time   string            `json:"ts"`
+	Host   string            `json:"host"`
+	File   string            `json:"file"`
+	Input  string            `json:"input,omitempty"`
+	Stream string            `json:"stream"`
+	Offset int64             `json:"offset"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Msg    string            `json:"msg"`
+}
+
+// writeData writes the data of a frame at the source offset to the output
+// file in the format of the output. It returns the number of bytes of the
+// data written.
+func (stream *ServerLogStream) writeData(h frameHeader, data []byte) (int, error) {
+	if err := stream.refreshSink(); err != nil {
+		return 0, err
+	}
+	if stream.format != FormatJSONL && stream.timestamp == "" {
+		return stream.sink.Write(data)
+	}
+	n := len(data)
+	// Lines of streams not in line mode may be split over frames. Only
+	// complete lines are written, as other streams may write to the output.
+	offset := h.offset
+	if len(stream.partial) > 0 {
+		offset = stream.partialOffset
+		data = append(stream.partial, data...)
+		stream.partial = nil
+	}
+	complete := data
+	if h.records == nil {
+		complete = data[:bytes.LastIndexByte(data, '\n')+1]
+		// A line never completed is written once it exceeds the frame size
+		if len(complete) == 0 && len(data) > maxFrameSize {
+			complete = data
+		}
+		if len(complete) < len(data) {
+			stream.partial = append([]byte{}, data[len(complete):]...)
+			stream.partialOffset = offset + int64(len(complete))
+		}
+	}
+	if len(complete) == 0 {
+		return n, nil
+	}
+	if stream.format != FormatJSONL {
+		if _, err := stream.sink.Write(stream.prefixLines(complete)); err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+	records, err := splitRecords(complete, h.records)
+	if err != nil {
+		log.Warn().Err(err).Str("stream", stream.streamID).Int64("offset", h.offset).Msg("Records do not match lines of stream data")
+	}
+	if _, err := stream.sink.Write(stream.encodeRecords(offset, records)); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// prefixLines returns the lines of a raw output, each prefixed with the
+// receive time (and host)
+func (stream *ServerLogStream) prefixLines(data []byte) []byte {
+	prefix := time.Now().Format(stream.timestamp) + " "
+	if stream.timestampHost {
+		prefix = prefix + stream.hostname + " "
+	}
+	buf := make([]byte, 0, len(data)+len(prefix)*(bytes.Count(data, []byte("\n"))+1))
+	for rest := data; len(rest) > 0; {
+		line := rest
+		if nl := bytes.IndexByte(rest, '\n'); nl >= 0 {
+			line = rest[:nl+1]
+		}
+		buf = append(append(buf, prefix...), line...)
+		rest = rest[len(line):]
+	}
+	return buf
+}
+
+// flushPartial writes a partial last line held back, after the stream ended
+func (stream *ServerLogStream) flushPartial() {
+	if len(stream.partial) == 0 {
+		return
+	}
+	data := stream.encodeRecords(stream.partialOffset, [][]byte{stream.partial})
+	if stream.format != FormatJSONL {
+		data = stream.prefixLines(append(stream.partial, '\n'))
+	}
+	if _, err := stream.sink.Write(data); err != nil {
+		log.Error().Err(err).Str("stream", stream.streamID).Str("localfile", stream.sink.Name()).Msg("Failed to write partial line")
+	}
+	stream.partial = nil
+}
+
+// encodeRecords returns the records starting at the source offset as JSON
+// objects with the metadata of the stream, one per line
+func (stream *ServerLogStream) encodeRecords(offset int64, records [][]byte) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	labels := map[string]string{}
+	for key, value := range stream.meta {
+		if !reservedMeta[key] {
+			labels[key] = value
+		}
+	}
+	ts := time.Now().Format(time.RFC3339Nano)
+	for _, record := range records {
+		msg := bytes.TrimSuffix(record, []byte("\n"))
+		err := enc.Encode(jsonRecord{Time: ts, Host: stream.hostname, File: stream.filename, Input: stream.meta["name"], Stream: stream.streamID, Offset: offset, Labels: labels, Msg: string(msg)})
+		if err != nil {
+			log.Error().Err(err).Str("stream", stream.streamID).Msg("Failed to encode record")
+		}
+		offset = offset + int64(len(record))
+	}
+	return buf.Bytes()
+}
+
+// writeMarker writes a line of loghamster itself, like a truncation marker,
+// in the format of the output
+func (stream *ServerLogStream) writeMarker(offset int64, format string, args ...interface{}) error {
+	line := []byte(fmt.Sprintf(format, args...) + "\n")
+	if stream.format == FormatJSONL {
+		_, err := stream.sink.Write(stream.encodeRecords(offset, [][]byte{line}))
+		return err
+	}
+	if stream.timestamp != "" {
+		line = stream.prefixLines(line)
+	}
+	_, err := stream.sink.Write(line)
+	return err
+}
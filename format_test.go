@@ -0,0 +1,197 @@
+package loghamster
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStream returns a stream writing to an output file in a temporary
+// directory
+func testStream(t *testing.T, format string, timestamp string) *ServerLogStream {
+	server := &Server{sinks: map[string]*outputSink{}}
+	sink, err := server.openSink(filepath.Join(t.TempDir(), "out.log"), "", 0, rotatePolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.releaseSink(sink) })
+	return &ServerLogStream{LogStream: &LogStream{streamID: "test", hostname: "web1", filename: "app.log"}, server: server, sink: sink, format: format, timestamp: timestamp}
+}
+
+// writeFrames writes the data frames to the stream like the session of the
+// server, returning the offset written after each frame
+func writeFrames(t *testing.T, stream *ServerLogStream, frames []string) []int64 {
+	var written []int64
+	for _, frame := range frames {
+		if _, err := stream.writeData(frameHeader{offset: stream.next, source: -1}, []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+		stream.next = stream.next + int64(len(frame))
+		written = append(written, stream.written())
+	}
+	return written
+}
+
+// outputLines returns the lines of the output file of the stream
+func outputLines(t *testing.T, stream *ServerLogStream) []string {
+	if err := stream.sink.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(stream.sink.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.SplitAfter(string(data), "\n")
+}
+
+func TestWrittenOffset(t *testing.T) {
+	tests := []struct {
+		frames  []string
+		written []int64
+	}{
+		{[]string{"one\n", "two\n"}, []int64{4, 8}},
+		{[]string{"one\ntw", "o\n"}, []int64{4, 8}},
+		{[]string{"on", "e", "\ntwo\nthr", "ee\n"}, []int64{0, 0, 8, 14}},
+		{[]string{"one\nt", "w", "o"}, []int64{4, 4, 4}},
+	}
+	for _, format := range []string{FormatJSONL, FormatRaw} {
+		for _, test := range tests {
+			stream := testStream(t, format, "RFC3339")
+			if written := writeFrames(t, stream, test.frames); !reflect.DeepEqual(written, test.written) {
+				t.Errorf("%s %q: written %v, want %v", format, test.frames, written, test.written)
+			}
+		}
+	}
+}
+
+func TestWriteDataPrefixesCompleteLines(t *testing.T) {
+	stream := testStream(t, FormatRaw, "2006")
+	stream.timestampHost = true
+	writeFrames(t, stream, []string{"one\ntw", "o\nthree\nfo", "ur"})
+	// Another stream writing to the output between the frames
+	other := *stream
+	other.LogStream = &LogStream{streamID: "other", hostname: "web2"}
+	other.partial = nil
+	writeFrames(t, &other, []string{"other\n"})
+	stream.flushPartial()
+	lines := outputLines(t, stream)
+	want := []string{"web1 one\n", "web1 two\n", "web1 three\n", "web2 other\n", "web1 four\n", ""}
+	if len(lines) != len(want) {
+		t.Fatalf("got %q, want %q", lines, want)
+	}
+	for i, line := range lines {
+		if line != "" {
+			line = line[strings.IndexByte(line, ' ')+1:]
+		}
+		if line != want[i] {
+			t.Errorf("line %d: got %q, want %q", i, line, want[i])
+		}
+	}
+}
+
+func TestWriteDataRawWithoutTimestamp(t *testing.T) {
+	stream := testStream(t, FormatRaw, "")
+	written := writeFrames(t, stream, []string{"one\ntw", "o\n"})
+	if written[0] != 6 || written[1] != 8 {
+		t.Errorf("written %v, want [6 8]", written)
+	}
+	if got := strings.Join(outputLines(t, stream), ""); got != "one\ntwo\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestAckCompletesCompressedData(t *testing.T) {
+	server := &Server{sinks: map[string]*outputSink{}}
+	sink, err := server.openSink(filepath.Join(t.TempDir(), "out.log"), CompressGzip, time.Hour, rotatePolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.releaseSink(sink)
+	stream := &ServerLogStream{LogStream: &LogStream{streamID: "test"}, server: server, sink: sink, format: FormatRaw}
+	client, conn := net.Pipe()
+	defer client.Close()
+	stream.conn = conn
+	writeFrames(t, stream, []string{"one\n", "two\n"})
+	stream.unacked = 2
+	go stream.ackPending()
+	if line, err := bufio.NewReader(client).ReadString('\n'); err != nil || line != "ACK 8\n" {
+		t.Fatalf("got %q, %v", line, err)
+	}
+	f, err := os.Open(sink.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil || string(data) != "one\ntwo\n" {
+		t.Errorf("got %q, %v after acknowledgement", data, err)
+	}
+}
+
+func TestCloseCompletesOutputs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{listener: &l, sinks: map[string]*outputSink{}, state: NewStateFile("")}
+	sink, err := server.openSink(filepath.Join(t.TempDir(), "out.log"), CompressGzip, time.Hour, rotatePolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sink.Write([]byte("one\n")); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	if _, err := l.Accept(); err == nil {
+		t.Error("accepted connection after close")
+	}
+	if _, err := sink.Write([]byte("two\n")); err == nil {
+		t.Error("wrote to output after close")
+	}
+	if _, err := server.openSink(filepath.Join(t.TempDir(), "new.log"), "", 0, rotatePolicy{}); err != errServerClosed {
+		t.Errorf("opened output after close: %v", err)
+	}
+	server.releaseSink(sink)
+	f, err := os.Open(sink.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil || string(data) != "one\n" {
+		t.Errorf("got %q, %v after close", data, err)
+	}
+}
+
+func TestAckHeldBackPartialLine(t *testing.T) {
+	stream := testStream(t, FormatJSONL, "")
+	stream.server.state = NewStateFile("")
+	stream.source = StreamState{Path: "web1:app.log", Device: 1, Inode: 2}
+	client, conn := net.Pipe()
+	defer client.Close()
+	stream.conn = conn
+	writeFrames(t, stream, []string{"one\ntw"})
+	stream.unacked = 1
+	go stream.ackPending()
+	if line, err := bufio.NewReader(client).ReadString('\n'); err != nil || line != "ACK 6\n" {
+		t.Fatalf("got %q, %v", line, err)
+	}
+	if checkpoint, _ := stream.server.state.Get("web1:app.log"); checkpoint.Offset != 4 {
+		t.Errorf("recorded offset %d, want 4", checkpoint.Offset)
+	}
+}
@@ -1,10 +1,20 @@
 module loghamster
 
-go 1.14
+go 1.22
 
 require (
 	github.com/VictoriaMetrics/metrics v1.11.3
 	github.com/fsnotify/fsnotify v1.4.9
 	github.com/jinzhu/configor v1.2.0
+	github.com/klauspost/compress v1.18.0
 	github.com/rs/zerolog v1.19.0
+	golang.org/x/time v0.9.0
+)
+
+require (
+	github.com/BurntSushi/toml v0.3.1 // indirect
+	github.com/valyala/fastrand v1.0.0 // indirect
+	github.com/valyala/histogram v1.0.1 // indirect
+	golang.org/x/sys v0.0.0-20191005200804-aed5e4c7ecf9 // indirect
+	gopkg.in/yaml.v2 v2.2.2 // indirect
 )
@@ -0,0 +1,240 @@
+package loghamster
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+// Handling of lines longer than the maximum length of an input in line mode
+const (
+	LongLinesSplit    = "split"
+	LongLinesTruncate = "truncate"
+)
+
+const (
+	// Default time a partial line is held back before it is sent anyway
+	defaultLineTimeout = 5 * time.Second
+	// Default maximum number of lines of a multiline record
+	defaultMultilineMaxLines = 500
+	// Marker appended to lines split or truncated at the maximum length
+	lineMarker = " [...]"
+)
+
+// Multiline groups the lines of an input into records, like the lines of a
+// stack trace. A record starts with a line matching Start, or with a line
+// not matching Continue.
+type Multiline struct {
+	Start    *regexp.Regexp
+	Continue *regexp.Regexp
+	MaxLines int           // Lines of a record, further lines start a new record
+	Timeout  time.Duration // Time to wait for more lines of the last record
+}
+
+// NewMultiline returns the grouping of lines by either a regex matching the
+// first line of a record or a regex matching continuation lines. Without
+// any regex nil is returned.
+func NewMultiline(start string, cont string, maxLines int, timeout time.Duration) (*Multiline, error) {
+	if start == "" && cont == "" {
+		return nil, nil
+	}
+	if start != "" && cont != "" {
+		return nil, fmt.Errorf("either a start or a continue regex is allowed for multiline records")
+	}
+	multiline := Multiline{MaxLines: maxLines, Timeout: timeout}
+	if multiline.MaxLines <= 0 {
+		multiline.MaxLines = defaultMultilineMaxLines
+	}
+	var err error
+	if start != "" {
+		multiline.Start, err = regexp.Compile(start)
+	} else {
+		multiline.Continue, err = regexp.Compile(cont)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &multiline, nil
+}
+
+// startsRecord returns true if the line (without line break) starts a new
+// record
+func (multiline *Multiline) startsRecord(line []byte) bool {
+	if multiline.Start != nil {
+		return multiline.Start.Match(line)
+	}
+	return !multiline.Continue.Match(line)
+}
+
+// lineFramer cuts the data read from an input file at line boundaries, so
+// a frame only holds complete lines, or complete records of lines. A
+// partial line or the last record at the end is held back until it is
+// completed or no more data arrived within the timeout.
+type lineFramer struct {
+	maxLength int           // Lines are split or truncated at the length
+	truncate  bool          // Drop the rest of long lines instead of sending it as lines of its own
+	timeout   time.Duration // Time data is held back without more data
+	multiline *Multiline    // Group lines into records, if set
+	skip      bool          // Dropping the rest of a truncated line
+	held      int64         // Position of the data held back
+	heldSize  int           // Size of the data held back, growing data restarts the timeout
+	heldSince time.Time
+	flush     bool // Send data held back without waiting, the file is complete
+}
+
+// lineEnd is the end of a line in the framed data and in the data read
+type lineEnd struct {
+	out    int
+	source int
+	split  bool // The line continues in the next line
+}
+
+// newLineFramer returns the line mode of the input, nil if the input is
+// sent in chunks of arbitrary size
+func newLineFramer(input InputFile) *lineFramer {
+	if !input.Lines && input.Multiline == nil {
+		return nil
+	}
+	lines := lineFramer{maxLength: input.MaxLineLength, truncate: input.LongLines == LongLinesTruncate, timeout: input.LineTimeout, multiline: input.Multiline, held: -1}
+	if lines.maxLength <= 0 {
+		lines.maxLength = defaultBuffersize
+	}
+	if lines.multiline != nil && lines.multiline.Timeout > 0 {
+		lines.timeout = lines.multiline.Timeout
+	}
+	if lines.timeout <= 0 {
+		lines.timeout = defaultLineTimeout
+	}
+	return &lines
+}
+
+// bufferSize returns the size of data to read at once, so every line up to
+// the maximum length fits in
+func (lines *lineFramer) bufferSize() int {
+	if lines.maxLength >= defaultBuffersize {
+		return lines.maxLength + 1
+	}
+	return defaultBuffersize
+}
+
+// frame returns the complete lines of the data read at the position, the
+// number of bytes of the data they cover and the number of lines of each
+// record, if lines are grouped. A full buffer without a line break splits
+// the line, as it does not fit into the buffer.
+func (lines *lineFramer) frame(data []byte, pos int64, full bool) ([]byte, int, []int) {
+	var out []byte
+	var ends []lineEnd
+	lead := 0 // Rest of a truncated line dropped before the first line
+	i := 0
+	for i < len(data) {
+		rest := data[i:]
+		nl := bytes.IndexByte(rest, '\n')
+		if lines.skip {
+			if nl < 0 {
+				i = len(data)
+			} else {
+				lines.skip = false
+				i = i + nl + 1
+			}
+			if len(ends) > 0 {
+				ends[len(ends)-1].source = i
+			} else {
+				lead = i
+			}
+			continue
+		}
+		if nl >= 0 && nl <= lines.maxLength {
+			out = append(out, rest[:nl+1]...)
+			i = i + nl + 1
+			ends = append(ends, lineEnd{out: len(out), source: i})
+			continue
+		}
+		if nl < 0 && len(rest) <= lines.maxLength && !(full && i == 0) {
+			break
+		}
+		cut := lines.maxLength
+		if cut > len(rest) {
+			cut = len(rest)
+		}
+		out = append(append(out, rest[:cut]...), lineMarker+"\n"...)
+		i = i + cut
+		ends = append(ends, lineEnd{out: len(out), source: i, split: !lines.truncate})
+		lines.skip = lines.truncate
+	}
+	partial := i < len(data)
+	if partial {
+		out = append(append(out, data[i:]...), '\n')
+		ends = append(ends, lineEnd{out: len(out), source: len(data)})
+	}
+	records := lines.group(out, ends)
+
+	// Hold back the last record or the partial line until it is completed
+	first := -1
+	if len(records) > 0 {
+		first = len(ends) - records[len(records)-1]
+	} else if partial {
+		first = len(ends) - 1
+	}
+	if first >= 0 && !(full && first == 0) {
+		outStart, start := 0, lead
+		if first > 0 {
+			outStart, start = ends[first-1].out, ends[first-1].source
+		}
+		if lines.held != pos+int64(start) || lines.heldSize != len(data)-start {
+			lines.held = pos + int64(start)
+			lines.heldSize = len(data) - start
+			lines.heldSince = time.Now()
+		}
+		if full || !(lines.flush || time.Since(lines.heldSince) >= lines.timeout) {
+			if records != nil {
+				records = records[:len(records)-1]
+			}
+			lines.skip = false
+			return out[:outStart], start, records
+		}
+	}
+	lines.held = -1
+	return out, len(data), records
+}
+
+// group returns the number of lines of each record of the framed lines,
+// nil if lines are not grouped
+func (lines *lineFramer) group(out []byte, ends []lineEnd) []int {
+	if lines.multiline == nil {
+		return nil
+	}
+	records := []int{}
+	start := 0
+	for k, end := range ends {
+		line := bytes.TrimSuffix(out[start:end.out], []byte("\n"))
+		start = end.out
+		last := len(records) - 1
+		switch {
+		case last < 0 || records[last] >= lines.multiline.MaxLines:
+			records = append(records, 1)
+		case ends[k-1].split:
+			records[last]++
+		case lines.multiline.startsRecord(line):
+			records = append(records, 1)
+		default:
+			records[last]++
+		}
+	}
+	return records
+}
+
+// resume continues at the position of the file after a rewind or reopen.
+// The rest of a truncated line is dropped, if the position is within a line.
+func (lines *lineFramer) resume(file io.ReaderAt, pos int64) {
+	lines.skip = false
+	lines.held = -1
+	if !lines.truncate || file == nil || pos == 0 {
+		return
+	}
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, pos-1); err == nil {
+		lines.skip = last[0] != '\n'
+	}
+}
@@ -21,6 +21,7 @@ const (
 // LogStream handles a log stream
 type LogStream struct {
 	conn     net.Conn
+	reader   *bufio.Reader
 	streamID string
 	hostname string
 	filename string
@@ -35,8 +36,18 @@ type LogStreamInterface interface {
 	awaitResponse()
 }
 
+// setConn will use the connection for the stream, all reads must use the
+// buffered reader to not lose data already read ahead
+func (stream *LogStream) setConn(conn net.Conn) {
+	stream.conn = conn
+	stream.reader = nil
+	if conn != nil {
+		stream.reader = bufio.NewReaderSize(conn, defaultBuffersize)
+	}
+}
+
 // Close logstream connection
-func (stream LogStream) Close() {
+func (stream *LogStream) Close() {
 	log.Debug().Str("stream", stream.streamID).Msg("Closing connection")
 	err := stream.conn.Close()
 
@@ -51,7 +62,7 @@ func (stream LogStream) Close() {
 }
 
 // writeMessage will write a single command to the server
-func (stream LogStream) writeMessage(msg string) error {
+func (stream *LogStream) writeMessage(msg string) error {
 	conn := stream.conn
 	if conn == nil {
 		log.Debug().Msg("No valid connection, returning.")
@@ -69,13 +80,13 @@ func (stream LogStream) writeMessage(msg string) error {
 }
 
 // awaitMessage will write a single command to the server
-func (stream LogStream) awaitMessage() (string, error) {
+func (stream *LogStream) awaitMessage() (string, error) {
 	conn := stream.conn
-	if conn == nil {
+	if conn == nil || stream.reader == nil {
 		log.Debug().Msg("No valid connection, returning.")
 		return "", io.ErrUnexpectedEOF
 	}
-	reader := bufio.NewReader(conn)
+	reader := stream.reader
 	log.Debug().Str("stream", stream.streamID).Msg("Reading and awaiting message on stream")
 	const timeoutDuration = 3 * time.Second
 	// conn.SetReadDeadline(time.Now().Add(timeoutDuration))
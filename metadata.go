@@ -0,0 +1,120 @@
+package loghamster
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+// Metadata keys used by the protocol, labels of inputs must not use them
+var reservedMeta = map[string]bool{
+	"name":      true,
+	"truncated": true,
+	"compress":  true,
+	"fileid":    true,
+	"size":      true,
+}
+
+// argEscaper escapes characters separating the arguments of a command
+var argEscaper = strings.NewReplacer("%", "%25", " ", "%20", ",", "%2C", "\t", "%09", "\n", "%0A", "\r", "%0D")
+
+// escapeArg escapes a value to be sent as part of a command argument
+func escapeArg(value string) string {
+	return argEscaper.Replace(value)
+}
+
+// unescapeArg reverts escapeArg, values not escaped properly (e.g. sent by
+// older clients) are returned unchanged
+func unescapeArg(value string) string {
+	unescaped, err := url.PathUnescape(value)
+	if err != nil {
+		return value
+	}
+	return unescaped
+}
+
+// validLabels returns the labels of an input without reserved keys
+func validLabels(labels map[string]string) map[string]string {
+	valid := map[string]string{}
+	for key, value := range labels {
+		if reservedMeta[key] || key == "" {
+			log.Warn().Str("label", key).Msg("Ignoring label with reserved key")
+			continue
+		}
+		valid[key] = value
+	}
+	return valid
+}
+
+// formatMeta returns the key:value arguments for the metadata sorted by key
+func formatMeta(meta map[string]string) string {
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&b, " %s:%s", escapeArg(key), escapeArg(meta[key]))
+	}
+	return b.String()
+}
+
+// parseSource will parse the host:/path argument sent on INIT. The path
+// may contain colons.
+func parseSource(arg string) (string, string, bool) {
+	kv := strings.SplitN(arg, ":", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return "", "", false
+	}
+	return unescapeArg(kv[0]), unescapeArg(kv[1]), true
+}
+
+// parseMetadata will parse key:value arguments sent on INIT
+func parseMetadata(args []string) map[string]string {
+	meta := map[string]string{}
+	for _, arg := range args {
+		kv := strings.SplitN(arg, ":", 2)
+		if len(kv) == 2 && kv[0] != "" {
+			meta[unescapeArg(kv[0])] = unescapeArg(kv[1])
+		}
+	}
+	return meta
+}
+
+// streamCounter returns the counter of a stream metric labeled with the
+// host and the configured metadata keys of the stream
+func streamCounter(name string, host string, meta map[string]string, keys []string) *metrics.Counter {
+	var b strings.Builder
+	fmt.Fprintf(&b, `%s{host="%s"`, name, escapeLabelValue(host))
+	for _, key := range keys {
+		if key == "host" {
+			continue
+		}
+		fmt.Fprintf(&b, `,%s="%s"`, sanitizeLabelName(key), escapeLabelValue(meta[key]))
+	}
+	b.WriteString("}")
+	return metrics.GetOrCreateCounter(b.String())
+}
+
+// escapeLabelValue escapes a Prometheus label value
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// sanitizeLabelName replaces characters not allowed in Prometheus label names
+func sanitizeLabelName(name string) string {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,28 @@
+//go:build linux
+// +build linux
+
+package loghamster
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// openFiles returns the device/inode of all regular files opened by
+// processes, read from /proc. Files of processes not accessible to the
+// client, like those of other users without privileges, are missing.
+func openFiles() (map[fileID]bool, error) {
+	fds, err := filepath.Glob("/proc/[0-9]*/fd/*")
+	if err != nil {
+		return nil, err
+	}
+	open := map[fileID]bool{}
+	for _, fd := range fds {
+		info, err := os.Stat(fd)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		open[getFileID(info)] = true
+	}
+	return open, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package loghamster
+
+import "errors"
+
+// openFiles is only supported on linux, files are considered closed once
+// they were not modified for a while
+func openFiles() (map[fileID]bool, error) {
+	return nil, errors.New("open files not supported")
+}
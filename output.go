@@ -0,0 +1,301 @@
+package loghamster
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog/log"
+)
+
+// Compression methods for output files
+const (
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+)
+
+// Default interval to complete a compressed member/frame and sync the file
+const defaultFlushInterval = 10 * time.Second
+
+// outputSink is an output file shared by all streams writing to it.
+// Compressed data is written as a sequence of independent gzip members or
+// zstd frames, each completed at a flush point. Standard tools (zcat,
+// zstdcat) can read the file while it is written and a crash loses at most
+// the data since the last flush point.
+type outputSink struct {
+	path          string
+	method        string
+	flushInterval time.Duration
+	rotation      rotatePolicy
+	file          *sinkFile
+	compressor    compressWriter
+	mutex         sync.Mutex
+	rotating      sync.Mutex // Held while rotated files are compressed and shifted
+	refs          int
+	pending       bool // Data written since the last flush point
+	buffered      bool // Data held by the compressor, not written to the file yet
+	lastFlush     time.Time
+	period        time.Time // Start of the rotation interval of the file
+	closed        bool
+}
+
+// compressWriter is implemented by gzip and zstd writers
+type compressWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// zstdWriter adapts the zstd encoder to the compressWriter interface
+type zstdWriter struct {
+	*zstd.Encoder
+}
+
+func (w zstdWriter) Reset(dst io.Writer) {
+	w.Encoder.Reset(dst)
+}
+
+// compressExtension returns the file extension for a compression method
+func compressExtension(method string) string {
+	switch method {
+	case CompressGzip:
+		return ".gz"
+	case CompressZstd:
+		return ".zst"
+	}
+	return ""
+}
+
+// newCompressWriter returns a compressor for the method writing to w
+func newCompressWriter(method string, w io.Writer) (compressWriter, error) {
+	switch method {
+	case "":
+		return nil, nil
+	case CompressGzip:
+		return gzip.NewWriter(w), nil
+	case CompressZstd:
+		enc, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zstdWriter{enc}, nil
+	}
+	return nil, fmt.Errorf("unknown compression method %s", method)
+}
+
+// openSink returns the shared output sink for the path, opening the file
+// for appending on first use. The extension of the compression method is
+// added to the path if missing.
+func (server *Server) openSink(path string, method string, flushInterval time.Duration, rotation rotatePolicy) (*outputSink, error) {
+	ext := compressExtension(method)
+	if ext != "" && !strings.HasSuffix(path, ext) {
+		path = path + ext
+	}
+	if flushInterval <= 0 {
+		flushInterval = defaultFlushInterval
+	}
+
+	server.sinkMutex.Lock()
+	defer server.sinkMutex.Unlock()
+	if server.closed {
+		return nil, errServerClosed
+	}
+	if sink, ok := server.sinks[path]; ok {
+		if sink.method != method {
+			log.Warn().Str("localfile", path).Str("method", sink.method).Str("requested", method).Msg("Output file already open with different compression")
+		}
+		sink.refs++
+		return sink, nil
+	}
+
+	f, modified, err := openSinkFile(path)
+	if err != nil {
+		log.Error().Err(err).Str("localfile", path).Msg("Failed to open file for writing")
+		return nil, err
+	}
+	compressor, err := newCompressWriter(method, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	sink := &outputSink{path: path, method: method, flushInterval: flushInterval, rotation: rotation, file: f, compressor: compressor, refs: 1, lastFlush: time.Now()}
+	sink.period = rotation.period(modified)
+	server.sinks[path] = sink
+	metricOutputsOpen.Inc()
+	log.Info().Str("localfile", path).Str("compress", method).Msg("Opened output file")
+	return sink, nil
+}
+
+// releaseSink drops a reference to the sink and closes it if unused
+func (server *Server) releaseSink(sink *outputSink) {
+	server.sinkMutex.Lock()
+	defer server.sinkMutex.Unlock()
+	sink.refs--
+	if sink.refs > 0 || server.sinks[sink.path] != sink {
+		// Still used or already closed on shutdown
+		return
+	}
+	delete(server.sinks, sink.path)
+	metricOutputsOpen.Dec()
+	if err := sink.Close(); err != nil {
+		log.Error().Err(err).Str("localfile", sink.path).Msg("Failed to close output file")
+	} else {
+		log.Info().Str("localfile", sink.path).Msg("Closed output file")
+	}
+}
+
+// flushSinks completes pending compressed data of idle sinks, so data is
+// readable after at most one flush interval, and rotates idle sinks
+func (server *Server) flushSinks() {
+	ticker := time.NewTicker(time.Second)
+	for now := range ticker.C {
+		server.sinkMutex.Lock()
+		sinks := make([]*outputSink, 0, len(server.sinks))
+		for _, sink := range server.sinks {
+			sinks = append(sinks, sink)
+		}
+		server.sinkMutex.Unlock()
+		for _, sink := range sinks {
+			sink.mutex.Lock()
+			if sink.pending && time.Since(sink.lastFlush) >= sink.flushInterval {
+				if err := sink.flush(); err != nil {
+					log.Error().Err(err).Str("localfile", sink.path).Msg("Failed to flush output file")
+				}
+			}
+			sink.mutex.Unlock()
+		}
+		server.rotateSinks(sinks, now)
+	}
+}
+
+// ReopenOutputs closes and reopens all open output files, e.g. after they
+// were moved by logrotate. Files are reopened between two writes, so
+// connected streams do not lose data.
+func (server *Server) ReopenOutputs() {
+	server.sinkMutex.Lock()
+	sinks := make([]*outputSink, 0, len(server.sinks))
+	for _, sink := range server.sinks {
+		sinks = append(sinks, sink)
+	}
+	server.sinkMutex.Unlock()
+	for _, sink := range sinks {
+		if err := sink.Reopen(); err != nil {
+			log.Error().Err(err).Str("localfile", sink.path).Msg("Failed to reopen output file")
+			continue
+		}
+		log.Info().Str("localfile", sink.path).Msg("Reopened output file")
+	}
+}
+
+// Name returns the path of the output file
+func (sink *outputSink) Name() string {
+	return sink.path
+}
+
+// Write will write (and compress) the data to the output file, rotating
+// it before if due
+func (sink *outputSink) Write(p []byte) (int, error) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if sink.closed {
+		return 0, os.ErrClosed
+	}
+	if sink.rotateDue(time.Now()) {
+		if err := sink.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	var err error
+	if sink.compressor != nil {
+		n, err = sink.compressor.Write(p)
+	} else {
+		n, err = sink.file.Write(p)
+	}
+	if n > 0 {
+		sink.pending = true
+		sink.buffered = sink.compressor != nil
+	}
+	if err == nil && time.Since(sink.lastFlush) >= sink.flushInterval {
+		err = sink.flush()
+	}
+	return n, err
+}
+
+// Sync will complete pending compressed data and sync the file to disk
+func (sink *outputSink) Sync() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	return sink.flush()
+}
+
+// Complete writes data held by the compressor to the output file as a
+// complete gzip member or zstd frame, without syncing the file to disk.
+// Data acknowledged to a client must never be held in memory only, as a
+// server crash would lose it unnoticed.
+func (sink *outputSink) Complete() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	return sink.complete()
+}
+
+// complete completes the current gzip member or zstd frame and starts a
+// new one. The sink must be locked.
+func (sink *outputSink) complete() error {
+	if !sink.buffered {
+		return nil
+	}
+	sink.buffered = false
+	if err := sink.compressor.Close(); err != nil {
+		return err
+	}
+	sink.compressor.Reset(sink.file)
+	return nil
+}
+
+// flush completes the current gzip member or zstd frame and syncs the file
+// to disk. The sink must be locked.
+func (sink *outputSink) flush() error {
+	sink.lastFlush = time.Now()
+	if !sink.pending {
+		return nil
+	}
+	sink.pending = false
+	if err := sink.complete(); err != nil {
+		return err
+	}
+	return sink.file.Sync()
+}
+
+// Reopen will flush pending data, close the output file and open the file
+// at the path again
+func (sink *outputSink) Reopen() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if err := sink.flush(); err != nil {
+		return err
+	}
+	if err := sink.file.Close(); err != nil {
+		log.Warn().Err(err).Str("localfile", sink.path).Msg("Failed to close output file for reopen")
+	}
+	return sink.reopenFile()
+}
+
+// Close will flush pending data and close the output file
+func (sink *outputSink) Close() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if sink.closed {
+		return nil
+	}
+	sink.closed = true
+	err := sink.flush()
+	if cerr := sink.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,295 @@
+package loghamster
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Default size of data read from a pipe held in memory
+	defaultPipeBuffer = 1024 * 1024
+	// Default size of the data of a pipe in the spool not sent yet
+	defaultMaxSpool = 1024 * 1024 * 1024
+	// Interval to check for free space in the spool and for sent data
+	pipeInterval = 500 * time.Millisecond
+)
+
+// pipeChunk is data read from a pipe, or the number of bytes dropped before
+// the data that follows
+type pipeChunk struct {
+	data    []byte
+	dropped int64
+}
+
+// pipeBuffer holds data read from a pipe in memory until it is written to
+// the spool. Data read while the buffer is full is dropped, so the program
+// writing to the pipe is never blocked. Data read at once is always queued
+// into an empty buffer.
+type pipeBuffer struct {
+	mutex   sync.Mutex
+	ready   *sync.Cond
+	chunks  []pipeChunk
+	size    int
+	max     int
+	dropped int64 // Bytes dropped since the last chunk queued
+	closed  bool
+}
+
+// newPipeBuffer returns a buffer holding up to max bytes
+func newPipeBuffer(max int) *pipeBuffer {
+	b := &pipeBuffer{max: max}
+	b.ready = sync.NewCond(&b.mutex)
+	return b
+}
+
+// put queues the data, or drops it and returns false if the buffer is full
+func (b *pipeBuffer) put(data []byte) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.size > 0 && b.size+len(data) > b.max {
+		b.dropped = b.dropped + int64(len(data))
+		return false
+	}
+	b.queueDropped()
+	b.chunks = append(b.chunks, pipeChunk{data: data})
+	b.size = b.size + len(data)
+	b.ready.Signal()
+	return true
+}
+
+// queueDropped queues the number of bytes dropped before the next data
+func (b *pipeBuffer) queueDropped() {
+	if b.dropped > 0 {
+		b.chunks = append(b.chunks, pipeChunk{dropped: b.dropped})
+		b.dropped = 0
+	}
+}
+
+// take returns the next chunk, waiting for data. It returns false once the
+// buffer was closed and all data was taken.
+func (b *pipeBuffer) take() (pipeChunk, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for len(b.chunks) == 0 && !b.closed {
+		b.ready.Wait()
+	}
+	if len(b.chunks) == 0 {
+		return pipeChunk{}, false
+	}
+	chunk := b.chunks[0]
+	b.chunks = b.chunks[1:]
+	b.size = b.size - len(chunk.data)
+	return chunk, true
+}
+
+// close ends the data of the buffer after the pipe was closed
+func (b *pipeBuffer) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.queueDropped()
+	b.closed = true
+	b.ready.Broadcast()
+}
+
+// pipeInput reads the data of a pipe (stdin or a named pipe) into a memory
+// buffer and writes it to a spool file, which is streamed with the input
+// name as logical file name. Unlike a file, a pipe cannot be read again, so
+// data is kept in the spool until the server acknowledged it. Once the
+// spool holds the maximum size of data not sent and the memory buffer is
+// full, data is dropped and a line with the number of bytes dropped is sent
+// instead.
+type pipeInput struct {
+	client   *Client
+	input    InputFile
+	spool    *spool
+	buffer   *pipeBuffer
+	maxSpool int64
+	midLine  bool // Last data written to the spool ended within a line
+	dropped  *metrics.Counter
+	done     chan struct{} // Closed after all data of the buffer was spooled
+}
+
+// newPipeInput creates the spool of the input and starts writing the data
+// read to the spool. Data left in the spool by a previous run is sent.
+func (client *Client) newPipeInput(input InputFile) (*pipeInput, error) {
+	spoolSize, err := parseSize(input.SpoolSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid spool size %s: %v", input.SpoolSize, err)
+	}
+	maxSpool, err := parseSize(input.MaxSpool)
+	if err != nil {
+		return nil, fmt.Errorf("invalid maximum spool size %s: %v", input.MaxSpool, err)
+	}
+	if maxSpool <= 0 {
+		maxSpool = defaultMaxSpool
+	}
+	bufferSize, err := parseSize(input.BufferSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid buffer size %s: %v", input.BufferSize, err)
+	}
+	if bufferSize <= 0 {
+		bufferSize = defaultPipeBuffer
+	}
+	spool, err := newSpool(filepath.Join(input.SpoolDir, input.Name), spoolSize, client.state)
+	if err != nil {
+		return nil, err
+	}
+	// Data of the pipe may end within a line at any time
+	input.Lines = true
+	pipe := &pipeInput{client: client, input: input, spool: spool, buffer: newPipeBuffer(int(bufferSize)), maxSpool: maxSpool, done: make(chan struct{})}
+	pipe.dropped = metrics.GetOrCreateCounter(fmt.Sprintf(`loghamster_input_dropped_bytes_total{input="%s"}`, escapeLabelValue(input.Name)))
+	if client.WatchDir != nil {
+		if err := client.WatchDir(spool.dir); err != nil {
+			log.Error().Err(err).Str("dir", spool.dir).Msg("Failed to watch spool dir of input")
+		}
+	}
+	if _, err := os.Stat(spool.path(input.Name)); err == nil {
+		pipe.startStream()
+	}
+	go pipe.run()
+	return pipe, nil
+}
+
+// startStream starts the stream of the spool file
+func (pipe *pipeInput) startStream() {
+	pipe.client.startStream(pipe.input, pipe.spool.path(pipe.input.Name), pipe.input.Name)
+}
+
+// read reads the data of the pipe into the buffer until it is closed
+func (pipe *pipeInput) read(r io.Reader) error {
+	dropping := false
+	for {
+		buf := make([]byte, defaultBuffersize)
+		n, err := r.Read(buf)
+		if n > 0 {
+			if pipe.buffer.put(buf[:n]) {
+				dropping = false
+			} else {
+				pipe.dropped.Add(n)
+				if !dropping {
+					log.Warn().Str("name", pipe.input.Name).Int64("maxspool", pipe.maxSpool).Msg("Spool of input full, dropping data")
+					dropping = true
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// run writes the data of the buffer to the spool, waiting while the spool
+// holds the maximum size of data not sent yet
+func (pipe *pipeInput) run() {
+	defer close(pipe.done)
+	name := pipe.input.Name
+	for {
+		chunk, ok := pipe.buffer.take()
+		if !ok {
+			return
+		}
+		data := chunk.data
+		if chunk.dropped > 0 {
+			log.Warn().Str("name", name).Int64("dropped", chunk.dropped).Msg("Dropped data of input")
+			data = []byte(fmt.Sprintf("loghamster: dropped %d bytes of input %s\n", chunk.dropped, name))
+			if pipe.midLine {
+				data = append([]byte("\n"), data...)
+			}
+		}
+		for pending := pipe.spool.pending(name); pending > 0 && pending+int64(len(data)) > pipe.maxSpool; pending = pipe.spool.pending(name) {
+			time.Sleep(pipeInterval)
+		}
+		_, opened, err := pipe.spool.write(name, data)
+		if err != nil {
+			log.Error().Err(err).Str("name", name).Msg("Failed to spool data of input")
+			pipe.dropped.Add(len(data))
+			continue
+		}
+		pipe.midLine = data[len(data)-1] != '\n'
+		if opened {
+			// Connecting the stream must not block spooling data
+			go pipe.startStream()
+		}
+	}
+}
+
+// wait waits until all data read was spooled and, within the timeout,
+// sent to the server. It returns false if data is left in the spool.
+func (pipe *pipeInput) wait(timeout time.Duration) bool {
+	<-pipe.done
+	deadline := time.Now().Add(timeout)
+	for !pipe.spool.drained(pipe.input.Name) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(pipeInterval)
+	}
+	return true
+}
+
+// ReadPipe sends the data read until the end of the reader, like stdin, as
+// the input. It waits up to the timeout until all data was sent and
+// returns an error if data was dropped or is left in the spool.
+func (client *Client) ReadPipe(input InputFile, r io.Reader, timeout time.Duration) error {
+	pipe, err := client.newPipeInput(input)
+	if err != nil {
+		return err
+	}
+	err = pipe.read(r)
+	pipe.buffer.close()
+	if err != nil {
+		return err
+	}
+	if !pipe.wait(timeout) {
+		return fmt.Errorf("data not sent within %s, kept in spool %s", timeout, pipe.spool.dir)
+	}
+	if dropped := pipe.dropped.Get(); dropped > 0 {
+		return fmt.Errorf("dropped %d bytes of input", dropped)
+	}
+	return nil
+}
+
+// ListenFifo sends the data written to the named pipe of the input by any
+// number of writers. The named pipe is created if it does not exist.
+func (client *Client) ListenFifo(input InputFile) {
+	info, err := os.Stat(input.Path)
+	if os.IsNotExist(err) {
+		err = mkfifo(input.Path)
+	} else if err == nil && info.Mode()&os.ModeNamedPipe == 0 {
+		err = fmt.Errorf("not a named pipe")
+	}
+	if err != nil {
+		log.Error().Err(err).Str("name", input.Name).Str("path", input.Path).Msg("Failed to create named pipe of input")
+		return
+	}
+	pipe, err := client.newPipeInput(input)
+	if err != nil {
+		log.Error().Err(err).Str("name", input.Name).Str("path", input.Path).Msg("Failed to spool named pipe of input")
+		return
+	}
+	log.Info().Str("name", input.Name).Str("path", input.Path).Msg("Reading named pipe of input")
+	for {
+		// Opening blocks until a writer opened the pipe, which is read until
+		// the last writer closed it
+		f, err := os.Open(input.Path)
+		if err != nil {
+			log.Error().Err(err).Str("name", input.Name).Str("path", input.Path).Msg("Failed to open named pipe of input")
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if err := pipe.read(f); err != nil {
+			log.Error().Err(err).Str("name", input.Name).Str("path", input.Path).Msg("Failed to read named pipe of input")
+		}
+		f.Close()
+	}
+}
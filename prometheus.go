@@ -15,8 +15,48 @@ var (
 	metricClientsConnected = metrics.NewCounter("loghamster_clients_connected")
 	// Total number of connections since start
 	metricClientConnectsTotal = metrics.NewCounter("loghamster_connections_total")
+	// Total number of sessions multiplexing streams over a connection
+	metricSessionsTotal = metrics.NewCounter("loghamster_sessions_total")
 	// Total number of bytes received since start
 	metricBytesRecvTotal = metrics.NewCounter("loghamster_bytes_received_total")
+	// Total number of bytes received over the wire (compressed) since start
+	metricBytesRecvWireTotal = metrics.NewCounter("loghamster_bytes_received_wire_total")
+	// Total number of bytes sent by clients since start
+	metricBytesSentTotal = metrics.NewCounter("loghamster_bytes_sent_total")
+	// Total number of bytes sent over the wire (compressed) since start
+	metricBytesSentWireTotal = metrics.NewCounter("loghamster_bytes_sent_wire_total")
+	// Total number of bytes acknowledged by the server since start
+	metricBytesAckedTotal = metrics.NewCounter("loghamster_bytes_acked_total")
+	// Total number of multiline records sent by clients since start
+	metricRecordsSentTotal = metrics.NewCounter("loghamster_records_sent_total")
+	// Total number of multiline records received since start
+	metricRecordsRecvTotal = metrics.NewCounter("loghamster_records_received_total")
+	// Total number of input file rotations followed by clients
+	metricInputRotationsTotal = metrics.NewCounter("loghamster_input_rotations_total")
+	// Total number of bytes read from input files after they were rotated
+	metricInputRotatedBytesTotal = metrics.NewCounter("loghamster_input_rotated_bytes_total")
+	// Total number of input files truncated in place (copytruncate)
+	metricInputTruncationsTotal = metrics.NewCounter("loghamster_input_truncations_total")
+	// Total number of truncated sources reported by clients
+	metricTruncationsRecvTotal = metrics.NewCounter("loghamster_truncations_received_total")
+	// Total number of files sent after close
+	metricFilesSentTotal = metrics.NewCounter("loghamster_files_sent_total")
+	// Total number of files received and stored completely
+	metricFilesRecvTotal = metrics.NewCounter("loghamster_files_received_total")
+	// Total number of client streams retired after their input file vanished
+	metricStreamsRetiredTotal = metrics.NewCounter("loghamster_streams_retired_total")
+	// Total number of streams rejected by the server
+	metricStreamsRejectedTotal = metrics.NewCounter("loghamster_streams_rejected_total")
+	// Total number of failed TLS handshakes
+	metricTLSHandshakeFailuresTotal = metrics.NewCounter("loghamster_tls_handshake_failures_total")
+	// Total number of failed authentications of clients
+	metricAuthFailuresTotal = metrics.NewCounter("loghamster_auth_failures_total")
+	// Total number of streams rejected for a hostname not allowed by the client certificate or token
+	metricHostsRejectedTotal = metrics.NewCounter("loghamster_hosts_rejected_total")
+	// Total number of output files rotated by the server
+	metricOutputsRotatedTotal = metrics.NewCounter("loghamster_outputs_rotated_total")
+	// Number of open output files
+	metricOutputsOpen = metrics.NewCounter("loghamster_outputs_open")
 )
 
 // ListenPrometheus will provide application metrics via HTTP under e/metrics
@@ -0,0 +1,98 @@
+package loghamster
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+// newRateLimiter returns a token bucket limiting data to the rate in bytes
+// per second, the burst defaults to one second of data. Without a rate nil
+// is returned.
+func newRateLimiter(limit int, burst int) *rate.Limiter {
+	if limit <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = limit
+	}
+	return rate.NewLimiter(rate.Limit(limit), burst)
+}
+
+// throttle limits data read or sent by a set of rate limiters
+type throttle struct {
+	limiters  []*rate.Limiter
+	throttled *metrics.FloatCounter // Time spent waiting for the limiters
+}
+
+// newThrottle returns a throttle for the limiters of the input, which may
+// be nil. Without any limiter nil is returned.
+func newThrottle(name string, limiters ...*rate.Limiter) *throttle {
+	t := throttle{}
+	for _, limiter := range limiters {
+		if limiter != nil {
+			t.limiters = append(t.limiters, limiter)
+		}
+	}
+	if len(t.limiters) == 0 {
+		return nil
+	}
+	t.throttled = metrics.GetOrCreateFloatCounter(fmt.Sprintf(`loghamster_throttled_seconds_total{input="%s"}`, escapeLabelValue(name)))
+	return &t
+}
+
+// chunkSize returns the size of data to read at once, at most the burst
+// of all limiters
+func (t *throttle) chunkSize(size int) int {
+	if t == nil {
+		return size
+	}
+	for _, limiter := range t.limiters {
+		if burst := limiter.Burst(); burst < size {
+			size = burst
+		}
+	}
+	return size
+}
+
+// wait blocks until n bytes may be sent. More bytes than the burst of a
+// limiter are waited for in pieces of the burst.
+func (t *throttle) wait(n int) {
+	if t == nil || n <= 0 {
+		return
+	}
+	start := time.Now()
+	for _, limiter := range t.limiters {
+		for rest := n; rest > 0; {
+			piece := rest
+			if burst := limiter.Burst(); burst < piece {
+				piece = burst
+			}
+			if err := limiter.WaitN(context.Background(), piece); err != nil {
+				log.Warn().Err(err).Int("bytes", piece).Msg("Failed to wait for rate limit")
+				break
+			}
+			rest = rest - piece
+		}
+	}
+	if waited := time.Since(start); waited > time.Millisecond {
+		t.throttled.Add(waited.Seconds())
+	}
+}
+
+// throttledReader limits the rate of data read from the reader
+type throttledReader struct {
+	r        io.Reader
+	throttle *throttle
+}
+
+func (tr throttledReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p[:tr.throttle.chunkSize(len(p))])
+	tr.throttle.wait(n)
+	return n, err
+}
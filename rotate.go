@@ -0,0 +1,345 @@
+package loghamster
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Schedules to rotate output files
+const (
+	RotateHourly = "hourly"
+	RotateDaily  = "daily"
+)
+
+// rotatePolicy defines when an output file is rotated and how many
+// generations of rotated files are kept
+type rotatePolicy struct {
+	keep     int    // Number of rotated files kept, 0 keeps all
+	size     int64  // Rotate once the file reached the size in bytes, 0 to disable
+	interval string // Rotate at the start of each hour or day, empty to disable
+	compress string // Compress rotated files of uncompressed outputs with the method
+}
+
+// enabled returns true if output files are rotated at all
+func (policy rotatePolicy) enabled() bool {
+	return policy.size > 0 || policy.interval != ""
+}
+
+// period returns the start of the rotation interval containing t
+func (policy rotatePolicy) period(t time.Time) time.Time {
+	switch policy.interval {
+	case RotateHourly:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case RotateDaily:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+	return time.Time{}
+}
+
+// newRotatePolicy returns the rotation of an output. Keeping generations
+// without size or interval rotates daily.
+func newRotatePolicy(keep int, size string, interval string, compress bool, method string) (rotatePolicy, error) {
+	policy := rotatePolicy{keep: keep, interval: interval}
+	var err error
+	if policy.size, err = parseSize(size); err != nil {
+		return policy, err
+	}
+	switch interval {
+	case "":
+		if keep > 0 && policy.size == 0 {
+			policy.interval = RotateDaily
+		}
+	case RotateHourly, RotateDaily:
+	default:
+		return policy, fmt.Errorf("unknown rotate interval %s", interval)
+	}
+	if compress {
+		policy.compress = CompressGzip
+		if method != "" {
+			policy.compress = method
+		}
+		if compressExtension(policy.compress) == "" {
+			return policy, fmt.Errorf("unknown compression method %s", policy.compress)
+		}
+	}
+	return policy, nil
+}
+
+// parseSize parses a size in bytes with an optional suffix K, M or G
+func parseSize(size string) (int64, error) {
+	size = strings.TrimSpace(strings.ToUpper(size))
+	if size == "" {
+		return 0, nil
+	}
+	unit := int64(1)
+	size = strings.TrimSuffix(size, "B")
+	switch {
+	case strings.HasSuffix(size, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(size, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(size, "G"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		size = size[:len(size)-1]
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(size), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %s", size)
+	}
+	return n * unit, nil
+}
+
+// sinkFile is the open output file of a sink, counting its size
+type sinkFile struct {
+	*os.File
+	size int64
+}
+
+func (f *sinkFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	f.size = f.size + int64(n)
+	return n, err
+}
+
+// openSinkFile opens the output file for appending
+func openSinkFile(path string) (*sinkFile, time.Time, error) {
+	ensureDir(path)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, time.Time{}, err
+	}
+	modified := time.Now()
+	if info.Size() > 0 {
+		modified = info.ModTime()
+	}
+	return &sinkFile{File: f, size: info.Size()}, modified, nil
+}
+
+// rotateDue returns true if the output file must be rotated before more
+// data is written. An empty file is not rotated but moves on to the
+// current interval. The sink must be locked.
+func (sink *outputSink) rotateDue(now time.Time) bool {
+	if !sink.rotation.enabled() {
+		return false
+	}
+	if sink.file.size == 0 {
+		sink.period = sink.rotation.period(now)
+		return false
+	}
+	if sink.rotation.size > 0 && sink.file.size >= sink.rotation.size {
+		return true
+	}
+	return sink.rotation.interval != "" && sink.rotation.period(now).After(sink.period)
+}
+
+// rotate closes the output file, moves it to the first generation and
+// opens a new file. Streams keep writing to the sink, so no data is lost.
+// A file to compress is only renamed and compressed in the background, so
+// writers never wait for the compression. The sink must be locked.
+func (sink *outputSink) rotate() error {
+	if err := sink.flush(); err != nil {
+		return err
+	}
+	if err := sink.file.Close(); err != nil {
+		log.Error().Err(err).Str("localfile", sink.path).Msg("Failed to close output file for rotation")
+	}
+	var rotated string
+	var err error
+	if sink.rotation.compress != "" && sink.method == "" {
+		rotated = pendingPath(sink.path, time.Now())
+		if err = os.Rename(sink.path, rotated); err == nil {
+			go sink.compressPending()
+		}
+	} else {
+		rotated, err = shiftGenerations(sink.path, sink.method, sink.rotation)
+		if err == nil {
+			err = os.Rename(sink.path, rotated)
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Str("localfile", sink.path).Msg("Failed to rotate output file, continue writing")
+	}
+	if oerr := sink.reopenFile(); oerr != nil {
+		return oerr
+	}
+	if err == nil {
+		metricOutputsRotatedTotal.Inc()
+		log.Info().Str("localfile", sink.path).Str("rotated", rotated).Msg("Rotated output file")
+	}
+	return err
+}
+
+// Prefix of the name of rotated files waiting to be compressed
+const pendingPrefix = ".rotated-"
+
+// pendingPath returns the hidden path a rotated file waits at to be
+// compressed, ordered by the rotation time
+func pendingPath(path string, now time.Time) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+pendingPrefix+fmt.Sprintf("%019d", now.UnixNano()))
+}
+
+// compressPending compresses the rotated files of the sink waiting to be
+// compressed, oldest first, and moves each to the first generation. Files
+// left by a previous run are compressed as well.
+func (sink *outputSink) compressPending() {
+	sink.rotating.Lock()
+	defer sink.rotating.Unlock()
+	dir, prefix := filepath.Dir(sink.path), "."+filepath.Base(sink.path)+pendingPrefix
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Error().Err(err).Str("localfile", sink.path).Msg("Failed to find rotated output files to compress")
+		return
+	}
+	ext := compressExtension(sink.rotation.compress)
+	for _, entry := range entries {
+		name := entry.Name()
+		pending := filepath.Join(dir, name)
+		if _, err := os.Stat(pending); !strings.HasPrefix(name, prefix) || err != nil {
+			continue
+		}
+		compressed := pending
+		if strings.HasSuffix(name, ext) {
+			// Compressed by a previous run, unless the original is left
+			if _, err := os.Stat(strings.TrimSuffix(pending, ext)); err == nil {
+				continue
+			}
+		} else if compressed, err = compressRotated(pending, sink.rotation.compress); err != nil {
+			// Keep the data uncompressed
+			log.Error().Err(err).Str("localfile", pending).Msg("Failed to compress rotated output file")
+			compressed = pending
+		}
+		rotated, err := shiftGenerations(sink.path, sink.method, sink.rotation)
+		if err == nil {
+			if strings.HasSuffix(compressed, ext) {
+				rotated = rotated + ext
+			}
+			err = os.Rename(compressed, rotated)
+		}
+		if err != nil {
+			log.Error().Err(err).Str("localfile", compressed).Msg("Failed to move compressed output file to first generation")
+			continue
+		}
+		log.Debug().Str("localfile", rotated).Str("compress", sink.rotation.compress).Msg("Compressed rotated output file")
+	}
+}
+
+// reopenFile opens the output file again after it was closed. The sink
+// must be locked.
+func (sink *outputSink) reopenFile() error {
+	f, modified, err := openSinkFile(sink.path)
+	if err != nil {
+		log.Error().Err(err).Str("localfile", sink.path).Msg("Failed to reopen output file")
+		return err
+	}
+	sink.file = f
+	sink.period = sink.rotation.period(modified)
+	if sink.compressor != nil {
+		sink.compressor.Reset(sink.file)
+	}
+	return nil
+}
+
+// generationPath returns the path of a rotated generation of an output
+// file, before the extension of a compressed output (app.log.1.gz)
+func generationPath(path string, method string, generation int) string {
+	ext := compressExtension(method)
+	return strings.TrimSuffix(path, ext) + "." + strconv.Itoa(generation) + ext
+}
+
+// shiftGenerations renames the rotated files of the output to the next
+// generation, removing generations not kept. It returns the free path of
+// the first generation.
+func shiftGenerations(path string, method string, policy rotatePolicy) (string, error) {
+	// Rotated files of uncompressed outputs may have been compressed
+	exists := func(name string) (string, bool) {
+		for _, candidate := range []string{name, name + compressExtension(policy.compress)} {
+			if _, err := os.Stat(candidate); err == nil {
+				return candidate, true
+			}
+		}
+		return "", false
+	}
+	last := 1
+	for {
+		if _, ok := exists(generationPath(path, method, last)); !ok {
+			break
+		}
+		last++
+	}
+	for generation := last - 1; generation >= 1; generation-- {
+		current, _ := exists(generationPath(path, method, generation))
+		if policy.keep > 0 && generation >= policy.keep {
+			if err := os.Remove(current); err != nil {
+				return "", err
+			}
+			log.Debug().Str("localfile", current).Msg("Removed rotated output file")
+			continue
+		}
+		next := generationPath(path, method, generation+1) + strings.TrimPrefix(current, generationPath(path, method, generation))
+		if err := os.Rename(current, next); err != nil {
+			return "", err
+		}
+	}
+	return generationPath(path, method, 1), nil
+}
+
+// compressRotated compresses a rotated output file, removes the original
+// and returns the path of the compressed file
+func compressRotated(path string, method string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+compressExtension(method), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0660)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+	w, err := newCompressWriter(method, dst)
+	if err == nil {
+		_, err = io.Copy(w, src)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	if err := os.Remove(path); err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
+
+// rotateSinks rotates idle output files at the start of a new interval
+func (server *Server) rotateSinks(sinks []*outputSink, now time.Time) {
+	for _, sink := range sinks {
+		sink.mutex.Lock()
+		if sink.rotateDue(now) {
+			if err := sink.rotate(); err != nil {
+				log.Error().Err(err).Str("localfile", sink.path).Msg("Failed to rotate output file")
+			}
+		}
+		sink.mutex.Unlock()
+	}
+}
@@ -0,0 +1,267 @@
+package loghamster
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Transfer methods for an input
+const (
+	// MethodStream follows the input file and streams new data immediately
+	MethodStream = "stream"
+	// MethodSendAfterClose sends rotated files verbatim once they are closed
+	MethodSendAfterClose = "send-after-close"
+	// MethodSyslog receives syslog messages and streams them by program or facility
+	MethodSyslog = "syslog"
+	// MethodFifo reads a named pipe and streams the data written to it
+	MethodFifo = "fifo"
+)
+
+// Actions for a rotated file after the server confirmed it
+const (
+	AfterSendKeep    = "keep"
+	AfterSendDelete  = "delete"
+	AfterSendArchive = "archive"
+)
+
+const (
+	// Time a rotated file must not be modified to be considered closed
+	sendAfterCloseSettle = 10 * time.Second
+	// Interval to look for new rotated files
+	sendAfterCloseInterval = 30 * time.Second
+)
+
+// compressedName matches names of rotated files compressed by logrotate,
+// like app.log.2.gz, which hold data of a generation sent before
+var compressedName = regexp.MustCompile(`\.(gz|bz2|xz|zst|lz4)$`)
+
+// SendAfterClose will look for rotated files of the input and send each
+// of them once as a whole after it was closed. Without a pattern for
+// rotated files, all files starting with the input path and a dot are used,
+// except files compressed by logrotate.
+func (client *Client) SendAfterClose(input InputFile) {
+	skipCompressed := input.Rotated == ""
+	if skipCompressed {
+		input.Rotated = input.Path + ".*"
+	}
+	log.Info().Str("name", input.Name).Str("rotated", input.Rotated).Str("aftersend", input.AfterSend).Msg("Watching for rotated files to send after close")
+	for {
+		client.sendRotatedFiles(input, skipCompressed)
+		time.Sleep(sendAfterCloseInterval)
+	}
+}
+
+// sendRotatedFiles will send all rotated files of the input not sent yet,
+// once no process has them open and they were not modified for a while
+func (client *Client) sendRotatedFiles(input InputFile, skipCompressed bool) {
+	paths, err := filepath.Glob(input.Rotated)
+	if err != nil {
+		log.Error().Err(err).Str("rotated", input.Rotated).Msg("Invalid pattern for rotated files")
+		return
+	}
+	// Records of renamed files are moved before any file is sent, as a file
+	// sent may take the path of a file sent before
+	sent := client.sentFiles()
+	pending := []rotatedFile{}
+	for _, path := range paths {
+		if skipCompressed && compressedName.MatchString(path) {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if time.Since(info.ModTime()) < sendAfterCloseSettle {
+			log.Debug().Str("path", path).Msg("Rotated file still modified, waiting to send it")
+			continue
+		}
+		file := rotatedFile{path: path, id: getFileID(info), size: info.Size()}
+		if client.isFileSent(sent, file) {
+			continue
+		}
+		pending = append(pending, file)
+	}
+	if len(pending) > 0 {
+		// A writer may keep a rotated file open without writing for a while
+		if open, err := openFiles(); err == nil {
+			closed := pending[:0]
+			for _, file := range pending {
+				if file.id != (fileID{}) && open[file.id] {
+					log.Debug().Str("path", file.path).Msg("Rotated file still open, waiting to send it")
+					continue
+				}
+				closed = append(closed, file)
+			}
+			pending = closed
+		}
+	}
+	for _, file := range pending {
+		if err := client.SendFile(input, file.path); err != nil {
+			log.Error().Err(err).Str("path", file.path).Msg("Failed to send rotated file")
+			continue
+		}
+		client.afterSend(input, file.path, file.id, file.size)
+	}
+	client.pruneSentFiles(input.Rotated, paths)
+}
+
+// SendFile will send the file of the input verbatim to the server and
+// wait until the server confirms that it was stored completely
+func (client *Client) SendFile(input InputFile, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	stream := NewLogStream(client.server, client.Hostname, path)
+	stream.tls = client.TLS
+	stream.auth = client.Auth
+	if err := stream.dial(); err != nil {
+		return err
+	}
+	defer stream.Disconnect()
+
+	init := fmt.Sprintf("INIT FILE %s:%s size:%d", escapeArg(client.Hostname), escapeArg(path), info.Size())
+	if input.Name != "" {
+		init = init + fmt.Sprintf(" name:%s", escapeArg(input.Name))
+	}
+	init = init + formatMeta(validLabels(input.Labels))
+	stream.writeMessage(init)
+	line, err := stream.awaitMessage()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK") {
+		return fmt.Errorf("file not accepted by server: %s", strings.TrimSpace(line))
+	}
+	log.Info().Str("stream", stream.streamID).Str("path", path).Int64("size", info.Size()).Msg("Sending file to server")
+	var reader io.Reader = file
+	if t := newThrottle(input.Name, input.limiter, client.limiter); t != nil {
+		reader = throttledReader{file, t}
+	}
+	n, err := io.CopyN(stream.conn, reader, info.Size())
+	if err != nil {
+		return err
+	}
+	// The server confirms after the file was stored completely
+	line, err = stream.awaitMessage()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK") {
+		return fmt.Errorf("file not stored by server: %s", strings.TrimSpace(line))
+	}
+	metricFilesSentTotal.Inc()
+	log.Info().Str("stream", stream.streamID).Str("path", path).Int64("bytes", n).Msg("File sent and confirmed by server")
+	return nil
+}
+
+// afterSend will keep, delete or archive the file after it was sent
+func (client *Client) afterSend(input InputFile, path string, id fileID, size int64) {
+	switch input.AfterSend {
+	case AfterSendDelete:
+		if err := os.Remove(path); err != nil {
+			log.Error().Err(err).Str("path", path).Msg("Failed to delete sent file")
+			break
+		}
+		log.Info().Str("path", path).Msg("Deleted sent file")
+		return
+	case AfterSendArchive:
+		archive := filepath.Join(input.ArchiveDir, filepath.Base(path))
+		err := os.MkdirAll(input.ArchiveDir, 0750)
+		if err == nil {
+			err = os.Rename(path, archive)
+		}
+		if err != nil {
+			log.Error().Err(err).Str("path", path).Str("archive", archive).Msg("Failed to archive sent file")
+			break
+		}
+		log.Info().Str("path", path).Str("archive", archive).Msg("Archived sent file")
+		return
+	}
+	// Remember the file was sent, as it is kept in place
+	err := client.state.Update(StreamState{
+		Path:     path,
+		Device:   id.Device,
+		Inode:    id.Inode,
+		Offset:   size,
+		LastRead: time.Now(),
+		Sent:     true,
+	})
+	if err != nil {
+		log.Error().Err(err).Str("path", path).Msg("Failed to record sent file in state file")
+	}
+}
+
+// rotatedFile is a rotated file of an input found to send
+type rotatedFile struct {
+	path string
+	id   fileID
+	size int64
+}
+
+// sentFiles returns the records of the files sent by device/inode
+func (client *Client) sentFiles() map[fileID]StreamState {
+	sent := map[fileID]StreamState{}
+	for _, checkpoint := range client.state.All() {
+		if checkpoint.Sent {
+			sent[fileID{Device: checkpoint.Device, Inode: checkpoint.Inode}] = checkpoint
+		}
+	}
+	return sent
+}
+
+// isFileSent will check the state file, if the file was already sent. Files
+// are found by device/inode, as numbered rotated files get a new path on
+// every rotation, and the record of a renamed file is moved to its path.
+func (client *Client) isFileSent(sent map[fileID]StreamState, file rotatedFile) bool {
+	checkpoint, ok := client.state.Get(file.path)
+	if file.id != (fileID{}) {
+		checkpoint, ok = sent[file.id]
+	}
+	if !ok || !checkpoint.Sent || checkpoint.Device != file.id.Device || checkpoint.Inode != file.id.Inode || checkpoint.Offset != file.size {
+		return false
+	}
+	if checkpoint.Path != file.path {
+		log.Debug().Str("path", file.path).Str("previous", checkpoint.Path).Msg("Sent file was renamed, moving record in state file")
+		// The previous path may be taken by another file sent already
+		if current, ok := client.state.Get(checkpoint.Path); ok && current.Device == checkpoint.Device && current.Inode == checkpoint.Inode {
+			client.state.Remove(checkpoint.Path)
+		}
+		checkpoint.Path = file.path
+		if err := client.state.Update(checkpoint); err != nil {
+			log.Error().Err(err).Str("path", file.path).Msg("Failed to record sent file in state file")
+		}
+	}
+	return true
+}
+
+// pruneSentFiles will remove sent files matching the pattern from the
+// state file, once they are gone
+func (client *Client) pruneSentFiles(pattern string, paths []string) {
+	existing := map[string]bool{}
+	for _, path := range paths {
+		existing[path] = true
+	}
+	for _, checkpoint := range client.state.All() {
+		if !checkpoint.Sent || existing[checkpoint.Path] {
+			continue
+		}
+		if matched, _ := filepath.Match(pattern, checkpoint.Path); matched {
+			log.Debug().Str("path", checkpoint.Path).Msg("Removing vanished sent file from state file")
+			client.state.Remove(checkpoint.Path)
+		}
+	}
+}
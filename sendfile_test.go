@@ -0,0 +1,73 @@
+package loghamster
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestSentFilesWithoutStateFile(t *testing.T) {
+	client := NewClient("127.0.0.1:0", NewFileManager(), nil)
+	path := filepath.Join(t.TempDir(), "app.log.1")
+	if err := os.WriteFile(path, []byte("rotated\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := rotatedFile{path: path, id: getFileID(info), size: info.Size()}
+	if client.isFileSent(client.sentFiles(), file) {
+		t.Fatal("file sent before it was sent")
+	}
+	client.afterSend(InputFile{AfterSend: AfterSendKeep}, file.path, file.id, file.size)
+	if !client.isFileSent(client.sentFiles(), file) {
+		t.Error("sent file not recognized")
+	}
+	// Renamed by logrotate
+	renamed := filepath.Join(filepath.Dir(path), "app.log.2")
+	if err := os.Rename(path, renamed); err != nil {
+		t.Fatal(err)
+	}
+	file.path = renamed
+	if !client.isFileSent(client.sentFiles(), file) {
+		t.Error("renamed sent file not recognized")
+	}
+}
+
+func TestCompressedName(t *testing.T) {
+	tests := map[string]bool{
+		"/var/log/app.log.1":           false,
+		"/var/log/app.log.2.gz":        true,
+		"/var/log/app.log-20261017.xz": true,
+		"/var/log/app.log.zst.1":       false,
+	}
+	for path, compressed := range tests {
+		if compressedName.MatchString(path) != compressed {
+			t.Errorf("%s: got %v, want %v", path, !compressed, compressed)
+		}
+	}
+}
+
+func TestOpenFiles(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("open files are only found on linux")
+	}
+	f, err := os.Create(filepath.Join(t.TempDir(), "app.log.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := getFileID(info)
+	if open, err := openFiles(); err != nil || !open[id] {
+		t.Errorf("open file not found: %v", err)
+	}
+	f.Close()
+	if open, err := openFiles(); err != nil || open[id] {
+		t.Errorf("closed file found: %v", err)
+	}
+}
@@ -1,36 +1,105 @@
 package loghamster
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/VictoriaMetrics/metrics"
 	"github.com/rs/zerolog/log"
 )
 
+// Number of data frames after which the server acknowledges at the latest
+const ackFrames = 16
+
+// Interval to write source offsets changed by acknowledgements to the state file
+const stateInterval = 5 * time.Second
+
+// errNoOutput is returned if a stream matches no configured output in strict mode
+var errNoOutput = errors.New("no output configured for stream")
+
+// errServerClosed is returned for output files opened after the server was closed
+var errServerClosed = errors.New("server closed")
+
 // Server handles a loghamster client connection
 type Server struct {
 	listener        *net.Listener
 	Address         string
 	OutputDirectory string
+	config          ServerConfig
 	files           *FileManager
 	streams         []ServerLogStream
+	sinks           map[string]*outputSink // Open output files by path
+	sinkMutex       sync.Mutex
+	closed          bool                  // Output files closed on shutdown, guarded by sinkMutex
+	tlsHosts        map[string][]*pattern // Hostnames allowed per client certificate name
+	tokens          map[string]*serverToken
+	state           *StateFile  // Source offsets of the data written by host and file
+	syslogClosers   []io.Closer // Syslog listeners and sockets, closed on shutdown
 }
 
 // ServerLogStream handles a log stream
 type ServerLogStream struct {
 	*LogStream
-	server    *Server
-	localFile *os.File
+	server        *Server
+	sink          *outputSink
+	meta          map[string]string // Metadata sent by the client on INIT
+	compress      string            // Compression of the stream data
+	nonce         string            // Challenge sent to the client, if authentication is enabled
+	token         *serverToken      // Token the client authenticated with
+	source        StreamState       // Offset of the data written for the source file
+	received      *metrics.Counter  // Bytes received for the source, labeled by metadata
+	codec         *wireCodec        // Decompression of data frames
+	next          int64             // Source offset of the next data expected, -1 if unknown
+	unacked       int               // Data frames received since the last acknowledgement
+	channel       string            // Channel of the stream within a session
+	format        string            // Format of the output file
+	partial       []byte            // Partial last line not written to jsonl or prefixed raw outputs yet
+	partialOffset int64             // Source offset of the partial line
+	timestamp     string            // Layout of the receive time prefixed to lines of raw outputs, if set
+	timestampHost bool              // Prefix lines with the host after the receive time
+	target        outputTarget      // Path template the output file was mapped by
+}
+
+// outputTarget is the path template and settings a stream was mapped to its
+// output file by. Dated templates are expanded again once the hour changed.
+type outputTarget struct {
+	template      string
+	vars          templateVars
+	path          string
+	compress      string
+	flushInterval time.Duration
+	rotation      rotatePolicy
+	until         time.Time // Time to expand a dated template again, zero if not dated
 }
 
 // NewServer initiates a new client connection
-func NewServer(address string, directory string, files *FileManager) (*Server, error) {
+func NewServer(config ServerConfig, files *FileManager) (*Server, error) {
+	address := config.Listen
+	if config.Compress && compressExtension(config.CompressMethod) == "" {
+		return nil, fmt.Errorf("unknown compression method %s", config.CompressMethod)
+	}
+	if !isFormat(config.Format) {
+		return nil, fmt.Errorf("unknown output format %s", config.Format)
+	}
+
+	tlsHosts, err := compileTLSHosts(config.TLS.Hosts)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := loadServerTokens(config.Auth)
+	if err != nil {
+		return nil, err
+	}
 
 	log.Info().Str("listen", address).Msg("Attempt to listen")
 	// connect to this socket
@@ -39,18 +108,89 @@ func NewServer(address string, directory string, files *FileManager) (*Server, e
 		log.Error().Err(err).Msg("Failed to listen at")
 		return nil, err
 	}
+	if config.TLS.Enabled {
+		tlsConfig, err := NewServerTLSConfig(config.TLS)
+		if err != nil {
+			l.Close()
+			log.Error().Err(err).Msg("Failed to setup TLS")
+			return nil, err
+		}
+		l = tls.NewListener(l, tlsConfig)
+		log.Info().Bool("requireClientCert", config.TLS.RequireClientCert).Msg("TLS enabled for connections")
+	}
 
 	log.Info().Interface("listener", l).Msg("Accept connections now")
 
-	server := Server{&l, address, directory, files, nil}
+	server := Server{listener: &l, Address: address, OutputDirectory: config.BaseDirectory, config: config, files: files}
+	server.sinks = map[string]*outputSink{}
+	server.tlsHosts = tlsHosts
+	server.tokens = tokens
+	server.state = NewStateFile(config.StateFile)
+	if err := server.state.Load(); err != nil {
+		log.Error().Err(err).Str("statefile", config.StateFile).Msg("Failed to load state file, starting without source offsets")
+	}
+	if err := server.listenSyslog(); err != nil {
+		l.Close()
+		log.Error().Err(err).Strs("syslog", config.Syslog).Msg("Failed to listen for syslog messages")
+		return nil, err
+	}
+	go server.flushSinks()
+	go server.persistState()
 	go server.acceptConnections(l)
 	return &server, err
 }
 
-func (server Server) acceptConnections(l net.Listener) error {
+// persistState writes the source offsets to the state file periodically.
+// The offsets in memory are used for streams initialized meanwhile.
+func (server *Server) persistState() {
+	ticker := time.NewTicker(stateInterval)
+	for range ticker.C {
+		server.SaveState()
+	}
+}
+
+// SaveState writes source offsets not written yet to the state file, like
+// before the server exits
+func (server *Server) SaveState() {
+	if err := server.state.Save(); err != nil {
+		log.Error().Err(err).Str("statefile", server.state.Path).Msg("Failed to write state file")
+	}
+}
+
+// Close stops accepting connections and syslog messages, completes and
+// closes all output files and writes the state file, like before the
+// server exits. Data received afterwards is neither written nor
+// acknowledged, so clients send it again.
+func (server *Server) Close() {
+	if err := (*server.listener).Close(); err != nil {
+		log.Warn().Err(err).Msg("Failed to close listener")
+	}
+	for _, c := range server.syslogClosers {
+		c.Close()
+	}
+	server.sinkMutex.Lock()
+	server.closed = true
+	for path, sink := range server.sinks {
+		delete(server.sinks, path)
+		metricOutputsOpen.Dec()
+		if err := sink.Close(); err != nil {
+			log.Error().Err(err).Str("localfile", path).Msg("Failed to close output file")
+		} else {
+			log.Info().Str("localfile", path).Msg("Closed output file")
+		}
+	}
+	server.sinkMutex.Unlock()
+	server.SaveState()
+}
+
+func (server *Server) acceptConnections(l net.Listener) error {
 	for {
 		log.Info().Interface("listener", l).Msg("Waiting for new connections")
 		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			log.Info().Msg("Stopped accepting connections")
+			return err
+		}
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to accept connections")
 			return err
@@ -60,18 +200,38 @@ func (server Server) acceptConnections(l net.Listener) error {
 		metricClientConnectsTotal.Inc()
 
 		streamID := generateStreamID()
-		stream := ServerLogStream{&LogStream{conn, streamID, "", ""}, &server, nil}
+		source := LogStream{streamID: streamID}
+		source.setConn(conn)
+		stream := ServerLogStream{LogStream: &source, server: server}
 		s := append(server.streams, stream)
 		log.Debug().Interface("stream", stream).Msg("Accepted connection, adding stream ")
 		server.streams = s
-		stream.writeMessage("# Welcome to LogHamster v" + Version)
+		go stream.handleConnection()
+	}
+}
+
+// handleConnection completes the TLS handshake, if enabled, sends the
+// welcome message and stream ID and handles the commands of the client
+func (stream ServerLogStream) handleConnection() {
+	if err := handshakeTLS(stream.conn); err != nil {
+		log.Warn().Err(err).Str("remote", stream.conn.RemoteAddr().String()).Msg("TLS handshake failed")
+		metricTLSHandshakeFailuresTotal.Inc()
+		stream.Close()
+		return
+	}
+	stream.writeMessage("# Welcome to LogHamster v" + Version)
+	if len(stream.server.tokens) > 0 {
+		// Format: STREAMID abcdef AUTH nonce
+		stream.nonce = generateNonce()
+		stream.writeMessage("STREAMID " + stream.streamID + " AUTH " + stream.nonce)
+	} else {
 		stream.writeMessage("STREAMID " + stream.streamID)
-		go stream.handleCommands()
 	}
+	stream.handleCommands()
 }
 
 // findStream will search for a stream in streams list
-func (server Server) findStream(streamID string) *ServerLogStream {
+func (server *Server) findStream(streamID string) *ServerLogStream {
 	var stream *ServerLogStream
 	streams := server.streams
 	for _, s := range streams {
@@ -101,6 +261,26 @@ func (stream ServerLogStream) handleCommands() {
 		args := cmds[1:]
 		log.Debug().Int("idx", cmdIdx).Str("cmd", cmd).Msg("Process command ")
 		switch cmd {
+		case "AUTH":
+			// Format: AUTH tokenid hmac
+			if len(args) < 2 || stream.nonce == "" {
+				stream.writeMessage("ERR 500 Missing arguments for " + cmd)
+				continue
+			}
+			stream.token = stream.server.authenticate(stream.nonce, stream.streamID, args[0], args[1])
+			if stream.token == nil {
+				log.Warn().Str("stream", stream.streamID).Str("token", args[0]).Str("remote", stream.conn.RemoteAddr().String()).Msg("Authentication failed")
+				metricAuthFailuresTotal.Inc()
+				stream.writeMessage("ERR 401 Authentication failed")
+				continue
+			}
+			log.Info().Str("stream", stream.streamID).Str("token", args[0]).Msg("Client authenticated")
+			stream.writeMessage("OK " + stream.streamID)
+		case "SESSION":
+			// Format: SESSION, all following commands are tagged with a channel
+			stream.writeMessage(fmt.Sprintf("OK %s SESSION", stream.streamID))
+			stream.handleSession()
+			return
 		case "INIT":
 			log.Debug().Str("line", line).Msg("Init logstream")
 			// Format: INIT STREAM host:/path/file srv:service more:meta
@@ -108,33 +288,29 @@ func (stream ServerLogStream) handleCommands() {
 				stream.writeMessage("ERR 500 Missing arguments for " + cmd)
 				continue
 			}
-			params := strings.Split(args[1], ":")
-			host, file := params[0], params[1]
-			log.Info().Str("host", host).Str("file", file).Msg("Using hostname/file")
-			// Based on hostname/filename a output configuration must be detected
-			err := stream.initStreamSink(host, file)
-			if err != nil {
-				log.Error().Err(err).Str("stream", stream.streamID).Str("host", host).Str("file", file).Msg("Failed to init stream")
+			host, file, valid := stream.checkSource(args[1], args[2:])
+			if !valid {
 				continue
 			}
-			if stream.localFile == nil {
-				log.Error().Err(err).Str("stream", stream.streamID).Str("host", host).Str("file", file).Msg("Failed to init stream, no file to stream to")
-				continue
+			if args[0] == "FILE" {
+				// Format: INIT FILE host:/path/file size:12345
+				n, err := stream.receiveFile(host, file, args[2:])
+				log.Info().Err(err).Str("stream", stream.streamID).Int64("count", n).Msg("File transfer completed")
+				break
 			}
-			stream.writeMessage(fmt.Sprintf("OK %s %d", stream.streamID, cmdIdx))
-			if err != nil {
-				log.Info().Msg("[ERROR] During writeMessage to client, aborting")
+			if !stream.initStream(host, file, args[2:], cmdIdx) {
 				continue
 			}
-			log.Info().Str("stream", stream.streamID).Str("localfile", stream.localFile.Name()).Msg("Streaming data to file")
 			metricClientsActive.Inc()
 			n, err := stream.copyStream()
+			stream.server.releaseSink(stream.sink)
+			stream.sink = nil
 			log.Info().Err(err).Str("stream", stream.streamID).Int64("count", n).Msg("Stream completed")
 			if err != nil {
 				if err == io.EOF {
 					log.Debug().Err(err).Str("stream", stream.streamID).Msg("EOF reached for stream")
 				} else {
-					stream.writeMessage("ERR 500 Failed after " + string(n) + " bytes from stream" + stream.streamID)
+					stream.writeMessage(fmt.Sprintf("ERR 500 Failed after %d bytes from stream %s", n, stream.streamID))
 				}
 			} else {
 				stream.writeMessage(fmt.Sprintf("OK %d %d", cmdIdx, n))
@@ -146,6 +322,102 @@ func (stream ServerLogStream) handleCommands() {
 	}
 }
 
+// checkSource parses the source and metadata sent on INIT and checks, if
+// the client may send data for the hostname. The client is informed, if not.
+func (stream *ServerLogStream) checkSource(arg string, args []string) (string, string, bool) {
+	host, file, valid := parseSource(arg)
+	if !valid {
+		stream.respond("ERR 500 Invalid source " + arg)
+		return "", "", false
+	}
+	stream.meta = parseMetadata(args)
+	log.Info().Str("host", host).Str("file", file).Interface("meta", stream.meta).Msg("Using hostname/file")
+	if stream.server.config.Auth.Enabled && stream.token == nil {
+		metricStreamsRejectedTotal.Inc()
+		metricAuthFailuresTotal.Inc()
+		stream.respond("ERR 401 Authentication required")
+		return "", "", false
+	}
+	if stream.token != nil && !stream.token.allowsHost(host) {
+		log.Warn().Str("host", host).Str("token", stream.token.id).Msg("Hostname not allowed for token")
+		metricStreamsRejectedTotal.Inc()
+		metricHostsRejectedTotal.Inc()
+		stream.respond(fmt.Sprintf("ERR 403 Host %s not allowed for token", host))
+		return "", "", false
+	}
+	if !stream.server.isHostAllowed(stream.conn, host) {
+		metricStreamsRejectedTotal.Inc()
+		metricHostsRejectedTotal.Inc()
+		stream.respond(fmt.Sprintf("ERR 403 Host %s not allowed for client certificate", host))
+		return "", "", false
+	}
+	return host, file, true
+}
+
+// initStream maps the stream to its output file and confirms it to the
+// client with the source offset held by the server
+func (stream *ServerLogStream) initStream(host string, file string, args []string, cmdIdx int) bool {
+	// Based on hostname/filename a output configuration must be detected
+	err := stream.initStreamSink(host, file)
+	if err != nil {
+		log.Error().Err(err).Str("stream", stream.streamID).Str("host", host).Str("file", file).Msg("Failed to init stream")
+		metricStreamsRejectedTotal.Inc()
+		if err == errNoOutput {
+			stream.respond(fmt.Sprintf("ERR 404 No output configured for %s:%s", host, file))
+		} else {
+			stream.respond(fmt.Sprintf("ERR 500 Failed to init stream for %s:%s", host, file))
+		}
+		return false
+	}
+	held := stream.initSource(host, file)
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "truncated:") {
+			stream.markTruncation(host, file, strings.TrimPrefix(arg, "truncated:"))
+			held = stream.resetSource()
+		}
+	}
+	stream.compress = ""
+	ok := fmt.Sprintf("OK %s %d", stream.streamID, cmdIdx)
+	if held >= 0 {
+		ok = ok + fmt.Sprintf(" offset:%d", held)
+	}
+	if requested, found := stream.meta["compress"]; found {
+		stream.compress = CompressNone
+		if isWireCompression(requested) {
+			stream.compress = requested
+		}
+		ok = ok + " compress:" + stream.compress
+	}
+	stream.codec, err = newWireCodec(stream.compress)
+	if err != nil {
+		log.Error().Err(err).Str("stream", stream.streamID).Str("compress", stream.compress).Msg("Failed to decompress stream data")
+		stream.server.releaseSink(stream.sink)
+		stream.sink = nil
+		stream.respond(fmt.Sprintf("ERR 500 Failed to init stream for %s:%s", host, file))
+		return false
+	}
+	stream.next = -1
+	stream.unacked = 0
+	stream.received = streamCounter("loghamster_stream_bytes_received_total", host, stream.meta, stream.server.config.MetricLabels)
+	if err := stream.respond(ok); err != nil {
+		log.Info().Msg("[ERROR] During writeMessage to client, aborting")
+		stream.server.releaseSink(stream.sink)
+		stream.sink = nil
+		return false
+	}
+	log.Info().Str("stream", stream.streamID).Str("localfile", stream.sink.Name()).Msg("Streaming data to file")
+	return true
+}
+
+// respond sends a response to the client, tagged with the channel of the
+// stream within a session (like OK <channel> ...)
+func (stream *ServerLogStream) respond(msg string) error {
+	if stream.channel != "" {
+		msg = tagChannel(msg, stream.channel)
+	}
+	return stream.writeMessage(msg)
+}
+
 func generateStreamID() string {
 	rand.Seed(time.Now().UnixNano())
 	chars := []rune("abcdef1234567890")
@@ -167,55 +439,335 @@ func ensureDir(fileName string) {
 	}
 }
 
-//initStreamSink initiates a new log stream
+// outputPath will map a stream to a file using the path template. Relative
+// paths are mapped below the output directory.
+func (server *Server) outputPath(template string, vars templateVars) (string, error) {
+	if filepath.IsAbs(template) {
+		localfile := filepath.Clean(expandPathTemplate(template, vars))
+		if strings.HasSuffix(localfile, string(filepath.Separator)) {
+			return "", fmt.Errorf("invalid output path %s for template %s", localfile, template)
+		}
+		return localfile, nil
+	}
+	directory := filepath.Clean(server.OutputDirectory)
+	localfile := filepath.Join(directory, expandPathTemplate(template, vars))
+	if rel, err := filepath.Rel(directory, localfile); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid output path %s for template %s", localfile, template)
+	}
+	return localfile, nil
+}
+
+// initStreamSink initiates a new log stream
 func (stream *ServerLogStream) initStreamSink(hostname string, file string) error {
-	// Map to logfile now and open it for writing
-	// TODO: use correct filename from mapping or deny init
-	var localfile string
-	directory := stream.server.OutputDirectory
-	localfile = fmt.Sprintf("%s/%s/%s.out.log", directory, hostname, strings.Trim(strings.Replace(file, "/", "_", -1), "_/"))
-	log.Info().Msgf("Initialized stream sink for %s:%s using default mapping: %s", hostname, file, localfile)
+	// Map to a configured output or the path template and open it for writing
+	config := stream.server.config
+	template := config.PathTemplate
+	compress := ""
+	if config.Compress {
+		compress = config.CompressMethod
+	}
+	format := config.Format
+	timestamp, timestampHost := config.Timestamp, config.TimestampHost
+	flushInterval := time.Duration(0)
+	rotation := rotatePolicy{}
+	output := stream.server.files.FindOutput(hostname, file, stream.meta)
+	if output != nil {
+		log.Info().Str("stream", stream.streamID).Str("output", output.Name).Str("path", output.Path).Msg("Stream matched configured output")
+		template = output.Path
+		compress = ""
+		if output.Compress {
+			compress = output.CompressMethod
+		}
+		if output.Format != "" {
+			format = output.Format
+		}
+		if output.Timestamp != "" {
+			timestamp, timestampHost = output.Timestamp, output.TimestampHost
+		}
+		flushInterval = output.FlushInterval
+		rotation = output.rotation
+	} else if config.Strict {
+		return errNoOutput
+	}
+	vars := templateVars{host: hostname, file: file, streamID: stream.streamID, meta: stream.meta, time: time.Now()}
+	localfile, err := stream.server.outputPath(template, vars)
+	if err != nil {
+		log.Error().Err(err).Str("host", hostname).Str("file", file).Msg("Failed to map stream to output file")
+		return err
+	}
+	log.Info().Msgf("Initialized stream sink for %s:%s using path template %s: %s", hostname, file, template, localfile)
+	sink, err := stream.server.openSink(localfile, compress, flushInterval, rotation)
+	if err != nil {
+		return err
+	}
+	stream.sink = sink
+	stream.target = outputTarget{template: template, vars: vars, path: localfile, compress: compress, flushInterval: flushInterval, rotation: rotation}
+	if isDatedTemplate(template) {
+		stream.target.until = nextHour(vars.time)
+	}
+	stream.hostname = hostname
+	stream.filename = file
+	stream.format = format
+	stream.partial = nil
+	stream.timestamp = timestampLayout(timestamp)
+	stream.timestampHost = timestampHost
+	return nil
+}
+
+// refreshSink maps the stream to its output file again once the date of a
+// dated path template changed, so streams connected for days follow the date
+func (stream *ServerLogStream) refreshSink() error {
+	now := time.Now()
+	if stream.target.until.IsZero() || now.Before(stream.target.until) {
+		return nil
+	}
+	stream.target.until = nextHour(now)
+	vars := stream.target.vars
+	vars.time = now
+	localfile, err := stream.server.outputPath(stream.target.template, vars)
+	if err != nil || localfile == stream.target.path {
+		return err
+	}
+	sink, err := stream.server.openSink(localfile, stream.target.compress, stream.target.flushInterval, stream.target.rotation)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("stream", stream.streamID).Str("localfile", localfile).Str("previous", stream.sink.Name()).Msg("Date of path template changed, switching output file")
+	if err := stream.sink.Sync(); err != nil {
+		log.Error().Err(err).Str("stream", stream.streamID).Str("localfile", stream.sink.Name()).Msg("Failed to sync output file")
+	}
+	stream.server.releaseSink(stream.sink)
+	stream.sink = sink
+	stream.target.path = localfile
+	return nil
+}
+
+// receiveFile stores a file sent verbatim under its original name in the
+// directory of the host and confirms it after it was written completely
+func (stream *ServerLogStream) receiveFile(hostname string, file string, args []string) (int64, error) {
+	size := int64(-1)
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "size:") {
+			size, _ = strconv.ParseInt(strings.TrimPrefix(arg, "size:"), 10, 64)
+		}
+	}
+	if size < 0 {
+		stream.writeMessage("ERR 500 Missing size for file " + file)
+		return 0, fmt.Errorf("missing size for file %s", file)
+	}
+
+	localfile := uniqueFilename(filepath.Join(stream.server.OutputDirectory, sanitizePathElement(hostname), sanitizePathElement(filepath.Base(file))))
 	ensureDir(localfile)
-	f, err := os.OpenFile(localfile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	partfile := filepath.Join(filepath.Dir(localfile), "."+filepath.Base(localfile)+".part")
+	f, err := os.OpenFile(partfile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0660)
+	if err != nil {
+		log.Error().Err(err).Str("localfile", partfile).Msg("Failed to open file for writing")
+		stream.writeMessage("ERR 500 Failed to open file for " + file)
+		return 0, err
+	}
+	stream.writeMessage(fmt.Sprintf("OK %s", stream.streamID))
+	log.Info().Str("stream", stream.streamID).Str("localfile", localfile).Int64("size", size).Msg("Receiving file")
+
+	n, err := io.CopyN(f, stream.reader, size)
+	metricBytesRecvTotal.Add(int(n))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(partfile, localfile)
+	}
 	if err != nil {
-		log.Error().Err(err).Str("localfile", localfile).Msg("Failed to open file for writing")
+		log.Error().Err(err).Str("stream", stream.streamID).Str("localfile", localfile).Int64("count", n).Msg("Failed to receive file")
+		os.Remove(partfile)
+		stream.writeMessage(fmt.Sprintf("ERR 500 Failed to receive file after %d bytes", n))
+		return n, err
 	}
-	stream.localFile = f
-	return err
+	metricFilesRecvTotal.Inc()
+	stream.writeMessage(fmt.Sprintf("OK %s %d", stream.streamID, n))
+	return n, nil
 }
 
-func (stream ServerLogStream) copyStream() (int64, error) {
-	conn := stream.conn
-	file := stream.localFile
-	bufsize := int64(defaultBuffersize)
+// uniqueFilename will return the filename or, if it already exists, the
+// filename with the first free numbered suffix (like app.log.1~2)
+func uniqueFilename(fileName string) string {
+	name := fileName
+	for i := 1; ; i++ {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s~%d", fileName, i)
+	}
+}
+
+// markTruncation writes a marker line to the output, so data sent after
+// the source was truncated is not silently merged with the previous data
+func (stream *ServerLogStream) markTruncation(hostname string, file string, pos string) {
+	log.Warn().Str("stream", stream.streamID).Str("host", hostname).Str("file", file).Str("pos", pos).Msg("Source was truncated, restarting at beginning")
+	metricTruncationsRecvTotal.Inc()
+	if err := stream.writeMarker(0, "--- loghamster: %s:%s truncated at offset %s, restarting at offset 0 ---", hostname, file, pos); err != nil {
+		log.Error().Err(err).Str("stream", stream.streamID).Str("localfile", stream.sink.Name()).Msg("Failed to write truncation marker")
+	}
+}
+
+// copyStream writes the data frames of the stream to the output file and
+// acknowledges the source offset of the data written
+func (stream *ServerLogStream) copyStream() (int64, error) {
 	total := int64(0)
-	retry := 0
 	for {
-		n, err := io.CopyN(file, conn, bufsize)
-		total = total + n
-		metricBytesRecvTotal.Add(int(n))
-		log.Debug().Str("stream", stream.streamID).Str("file", file.Name()).Int64("read", n).Int64("total", total).Msg("Read from stream to local file")
+		h, payload, err := readFrame(stream.reader, stream.codec != nil)
+		if err == nil {
+			var n int
+			n, err = stream.receiveFrame(h, payload)
+			total = total + int64(n)
+		}
 		if err != nil {
 			if err == io.EOF {
-				file.Sync()
-				retry = retry + 1
-				if retry < 2 {
-					log.Info().Str("stream", stream.streamID).Int("retry", retry).Msg("Retry reading/writing after 1 second")
-					time.Sleep(1 * time.Second)
-					continue
-				}
 				log.Info().Msg("EOF reached")
 				break
-			} else {
-				log.Error().Err(err).Str("stream", stream.streamID).Int64("bufsize", bufsize).Int64("count", n).Msg("Failed to read buffer")
+			}
+			log.Error().Err(err).Str("stream", stream.streamID).Int64("offset", h.offset).Msg("Failed to read data frame")
+			stream.finish()
+			return total, err
+		}
+		// Acknowledge at least every ackFrames frames or once the client paused
+		if stream.unacked >= ackFrames || stream.reader.Buffered() == 0 {
+			if err := stream.ackPending(); err != nil {
 				return total, err
 			}
 		}
-		retry = 0
 	}
 
-	log.Info().Str("stream", stream.streamID).Str("file", file.Name()).Int64("total", total).Msg("Stream completed")
-
-	file.Sync()
+	log.Info().Str("stream", stream.streamID).Str("file", stream.sink.Name()).Int64("total", total).Msg("Stream completed")
+	stream.finish()
 	return total, nil
 }
+
+// receiveFrame decodes the payload of a data frame and writes the data to
+// the output file. The source length covered by the data defaults to the
+// length of the data.
+func (stream *ServerLogStream) receiveFrame(h frameHeader, payload []byte) (int, error) {
+	data := payload
+	if stream.codec != nil {
+		var err error
+		if data, err = stream.codec.Decode(payload); err != nil {
+			return 0, err
+		}
+	}
+	if stream.next >= 0 && h.offset != stream.next {
+		log.Warn().Str("stream", stream.streamID).Int64("offset", h.offset).Int64("expected", stream.next).Msg("Unexpected source offset of stream data")
+	}
+	metricRecordsRecvTotal.Add(len(h.records))
+	n := 0
+	if len(data) > 0 {
+		var err error
+		n, err = stream.writeData(h, data)
+		metricBytesRecvTotal.Add(n)
+		stream.received.Add(n)
+		if err != nil {
+			log.Error().Err(err).Str("stream", stream.streamID).Str("file", stream.sink.Name()).Msg("Failed to write data to local file")
+			return n, err
+		}
+		log.Trace().Str("stream", stream.streamID).Str("file", stream.sink.Name()).Int("read", n).Int64("offset", h.offset).Msg("Read from stream to local file")
+	}
+	source := h.source
+	if source < 0 {
+		source = len(data)
+	}
+	stream.next = h.offset + int64(source)
+	stream.unacked = stream.unacked + 1
+	return n, nil
+}
+
+// ackPending acknowledges the data frames received since the last
+// acknowledgement
+func (stream *ServerLogStream) ackPending() error {
+	if stream.unacked == 0 {
+		return nil
+	}
+	stream.unacked = 0
+	return stream.ack(stream.next)
+}
+
+// written returns the source offset of the data written to the output
+// file. A partial line held back is not written yet, it is written once
+// the line is complete or the stream ended.
+func (stream *ServerLogStream) written() int64 {
+	if len(stream.partial) > 0 {
+		return stream.partialOffset
+	}
+	return stream.next
+}
+
+// finish syncs the output file and records the source offset of the data
+// written, after the stream ended
+func (stream *ServerLogStream) finish() {
+	stream.flushPartial()
+	stream.sink.Sync()
+	if stream.next >= 0 {
+		stream.saveSource(stream.next)
+	}
+	stream.server.SaveState()
+}
+
+// ack confirms all data up to the source offset was received and written
+// to the output file, synced to disk if configured. Compressed data is
+// completed first, so no acknowledged data is left in the compressor.
+// A partial line held back is acknowledged too, so a client draining a
+// file without final line break is not kept waiting, but only the offset
+// written is recorded. After a server failure the client resumes there and
+// sends the partial line again.
+func (stream *ServerLogStream) ack(offset int64) error {
+	err := stream.sink.Complete()
+	if err == nil && stream.server.config.AckSync {
+		err = stream.sink.Sync()
+	}
+	if err != nil {
+		log.Error().Err(err).Str("stream", stream.streamID).Str("localfile", stream.sink.Name()).Msg("Failed to write acknowledged data to output file")
+		return err
+	}
+	stream.saveSource(stream.written())
+	return stream.respond(fmt.Sprintf("ACK %d", offset))
+}
+
+// initSource looks up the offset of the data already written for the
+// source file identified by the client on INIT (fileid:<device>.<inode>).
+// It returns -1 if the server holds no data of this file.
+func (stream *ServerLogStream) initSource(hostname string, file string) int64 {
+	stream.source = StreamState{}
+	var id fileID
+	if _, err := fmt.Sscanf(stream.meta["fileid"], "%d.%d", &id.Device, &id.Inode); err != nil || id == (fileID{}) {
+		return -1
+	}
+	stream.source = StreamState{Path: hostname + ":" + file, Device: id.Device, Inode: id.Inode}
+	checkpoint, ok := stream.server.state.Get(stream.source.Path)
+	if !ok || checkpoint.Device != id.Device || checkpoint.Inode != id.Inode {
+		// Data of a previous file (before rotation) is not relevant
+		return -1
+	}
+	stream.source = checkpoint
+	log.Info().Str("stream", stream.streamID).Str("host", hostname).Str("file", file).Int64("offset", checkpoint.Offset).Msg("Resuming source at offset held by server")
+	return checkpoint.Offset
+}
+
+// resetSource restarts the source at the beginning after it was truncated
+func (stream *ServerLogStream) resetSource() int64 {
+	if stream.source.Path == "" {
+		return -1
+	}
+	stream.saveSource(0)
+	return 0
+}
+
+// saveSource records the source offset of the data written to the output.
+// The state file is written periodically and after the stream ended.
+func (stream *ServerLogStream) saveSource(offset int64) {
+	if stream.source.Path == "" || (stream.source.Offset == offset && !stream.source.LastRead.IsZero()) {
+		return
+	}
+	stream.source.Offset = offset
+	stream.source.LastRead = time.Now()
+	stream.server.state.Set(stream.source)
+}
@@ -0,0 +1,388 @@
+package loghamster
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// errSessionUnsupported is returned if the server does not support sessions
+var errSessionUnsupported = errors.New("sessions not supported by server")
+
+// tagChannel adds the channel of a stream within a session to a command
+// or response after its first word (like INIT <channel> STREAM ...)
+func tagChannel(msg string, channel string) string {
+	parts := strings.SplitN(msg, " ", 2)
+	msg = parts[0] + " " + channel
+	if len(parts) > 1 {
+		msg = msg + " " + parts[1]
+	}
+	return msg
+}
+
+// session multiplexes the streams of a client over a single connection.
+// Each stream is a channel of the session, a failed stream does not affect
+// the other streams. If the connection fails, all streams reconnect over a
+// new connection.
+type session struct {
+	client   *Client
+	mutex    sync.Mutex
+	conn     *sessionConn
+	disabled bool // Server does not support sessions
+}
+
+// sessionConn is a connection of a session carrying the streams by channel
+type sessionConn struct {
+	*ClientLogStream // Connection and handshake with the server
+	writeMutex       sync.Mutex
+	mutex            sync.Mutex
+	channels         map[int]*channel
+	next             int
+	done             chan struct{} // Closed after the connection failed
+	err              error
+}
+
+// channel is a stream within a session
+type channel struct {
+	id       int
+	conn     *sessionConn
+	response chan string // Response to INIT
+	acks     *ackTracker // Acknowledgements of data frames, once initialized
+}
+
+// connect returns the connection of the session, connecting to the server
+// if not connected yet or the connection failed
+func (s *session) connect() (*sessionConn, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.disabled {
+		return nil, errSessionUnsupported
+	}
+	if s.conn != nil && s.conn.alive() {
+		return s.conn, nil
+	}
+	client := s.client
+	base := NewLogStream(client.server, client.Hostname, "")
+	base.tls = client.TLS
+	base.auth = client.Auth
+	if err := base.dial(); err != nil {
+		return nil, err
+	}
+	base.writeMessage("SESSION")
+	line, err := base.awaitMessage()
+	if err != nil {
+		base.Disconnect()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "OK") {
+		log.Warn().Str("response", strings.TrimSpace(line)).Msg("Server does not support sessions, using a connection per stream")
+		base.Disconnect()
+		s.disabled = true
+		return nil, errSessionUnsupported
+	}
+	conn := &sessionConn{ClientLogStream: base, channels: map[int]*channel{}, done: make(chan struct{})}
+	go conn.run(base.reader)
+	s.conn = conn
+	metricSessionsTotal.Inc()
+	log.Info().Str("session", base.streamID).Str("server", client.server).Msg("Opened session for streams")
+	return conn, nil
+}
+
+// open initializes a stream within the session and returns its channel
+// and the response of the server to INIT without the channel
+func (s *session) open(init string) (*channel, string, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, "", err
+	}
+	ch := conn.newChannel()
+	if err := conn.write([]byte(tagChannel(init, strconv.Itoa(ch.id)) + "\n")); err != nil {
+		conn.release(ch)
+		return nil, "", err
+	}
+	timer := time.NewTimer(ackTimeout)
+	defer timer.Stop()
+	select {
+	case line := <-ch.response:
+		if !strings.HasPrefix(line, "OK") {
+			conn.release(ch)
+		}
+		return ch, line, nil
+	case <-conn.done:
+		return nil, "", conn.err
+	case <-timer.C:
+		conn.release(ch)
+		return nil, "", errAckTimeout
+	}
+}
+
+// alive returns true if the connection did not fail
+func (conn *sessionConn) alive() bool {
+	select {
+	case <-conn.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// newChannel registers a new channel on the connection
+func (conn *sessionConn) newChannel() *channel {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.next++
+	ch := &channel{id: conn.next, conn: conn, response: make(chan string, 1)}
+	conn.channels[ch.id] = ch
+	return ch
+}
+
+// release removes the channel from the connection
+func (conn *sessionConn) release(ch *channel) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	delete(conn.channels, ch.id)
+}
+
+// lookup returns the channel and its acknowledgements
+func (conn *sessionConn) lookup(id int) (*channel, *ackTracker) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	ch := conn.channels[id]
+	if ch == nil {
+		return nil, nil
+	}
+	return ch, ch.acks
+}
+
+// write sends a command or data frame, the connection fails on errors
+func (conn *sessionConn) write(p []byte) error {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+	if !conn.alive() {
+		return conn.err
+	}
+	_, err := countingWriter{conn.conn, metricBytesSentWireTotal}.Write(p)
+	if err != nil {
+		conn.fail(err)
+	}
+	return err
+}
+
+// fail closes the connection and wakes up the streams of all channels
+func (conn *sessionConn) fail(err error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if !conn.alive() {
+		return
+	}
+	log.Warn().Err(err).Str("session", conn.streamID).Int("channels", len(conn.channels)).Msg("Session connection failed")
+	conn.err = err
+	close(conn.done)
+	conn.conn.Close()
+	for _, ch := range conn.channels {
+		if ch.acks != nil {
+			ch.acks.fail(err)
+		}
+	}
+}
+
+// run reads the responses and acknowledgements of the server and
+// dispatches them to the channels until the connection fails.
+// Format: OK|ERR|ACK <channel> ...
+func (conn *sessionConn) run(reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			conn.fail(err)
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			log.Debug().Str("session", conn.streamID).Str("line", line).Msg("Ignoring unexpected message of session")
+			continue
+		}
+		id, err := strconv.Atoi(fields[1])
+		if err != nil {
+			log.Debug().Str("session", conn.streamID).Str("line", line).Msg("Ignoring message without channel")
+			continue
+		}
+		ch, acks := conn.lookup(id)
+		if ch == nil {
+			log.Debug().Str("session", conn.streamID).Int("channel", id).Str("line", strings.TrimSpace(line)).Msg("Ignoring message for closed channel")
+			continue
+		}
+		msg := strings.Join(append(fields[:1:1], fields[2:]...), " ")
+		switch {
+		case fields[0] == "ACK" && acks != nil:
+			offset, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+			if err != nil {
+				acks.fail(fmt.Errorf("unexpected response from server: %s", msg))
+				continue
+			}
+			acks.ack(offset)
+		case acks == nil:
+			select {
+			case ch.response <- msg:
+			default:
+			}
+		case fields[0] == "ERR":
+			acks.fail(fmt.Errorf("stream failed on server: %s", msg))
+		}
+	}
+}
+
+// start records the acknowledgements of the initialized stream
+func (ch *channel) start(acks *ackTracker) {
+	ch.conn.mutex.Lock()
+	defer ch.conn.mutex.Unlock()
+	ch.acks = acks
+	if !ch.conn.alive() {
+		acks.fail(ch.conn.err)
+	}
+}
+
+// writeFrame sends a data frame of the stream
+func (ch *channel) writeFrame(h frameHeader, payload []byte) error {
+	h.length = len(payload)
+	header := fmt.Sprintf("DATA %d %s\n", ch.id, h)
+	frame := make([]byte, 0, len(header)+len(payload))
+	frame = append(append(frame, header...), payload...)
+	return ch.conn.write(frame)
+}
+
+// close ends the stream on the server and releases the channel
+func (ch *channel) close() {
+	ch.conn.release(ch)
+	if ch.conn.alive() {
+		ch.conn.write([]byte(fmt.Sprintf("CLOSE %d\n", ch.id)))
+	}
+}
+
+// handleSession handles the streams of a client multiplexed over the
+// connection by channel. Formats:
+// INIT <channel> STREAM host:/path/file key:value ...
+// DATA <channel> <offset> <length> [<source length>] [records:...]\n<payload>
+// CLOSE <channel>
+func (stream *ServerLogStream) handleSession() {
+	log.Info().Str("session", stream.streamID).Str("remote", stream.conn.RemoteAddr().String()).Msg("Client opened session")
+	metricSessionsTotal.Inc()
+	channels := map[string]*ServerLogStream{}
+	defer func() {
+		for _, ch := range channels {
+			ch.closeChannel()
+		}
+		stream.conn.Close()
+	}()
+	cmdIdx := 0
+	for {
+		line, err := stream.reader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				log.Error().Err(err).Str("session", stream.streamID).Msg("Failed to read from session")
+			}
+			return
+		}
+		// Commas only separate arguments of commands, not the records of data
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] != "DATA" {
+			fields = strings.Fields(strings.Replace(line, ",", " ", -1))
+		}
+		if len(fields) < 2 {
+			stream.writeMessage("ERR 500 Missing channel")
+			continue
+		}
+		cmd, id, args := fields[0], fields[1], fields[2:]
+		switch cmd {
+		case "DATA":
+			metricBytesRecvWireTotal.Add(len(line))
+			// Frames of unknown channels are only dropped, whatever their compression
+			ch := channels[id]
+			h, err := parseFrameHeader(args, ch == nil || ch.codec != nil)
+			if err != nil {
+				log.Error().Str("session", stream.streamID).Str("line", strings.TrimSpace(line)).Msg("Invalid data frame in session")
+				return
+			}
+			payload, err := readPayload(stream.reader, h.length)
+			if err != nil {
+				log.Error().Err(err).Str("session", stream.streamID).Msg("Failed to read data frame of session")
+				return
+			}
+			if ch == nil {
+				log.Debug().Str("session", stream.streamID).Str("channel", id).Msg("Dropping data for unknown channel")
+				continue
+			}
+			if _, err := ch.receiveFrame(h, payload); err != nil {
+				log.Error().Err(err).Str("stream", ch.streamID).Int64("offset", h.offset).Msg("Failed to write data frame")
+				ch.respond(fmt.Sprintf("ERR 500 Failed to write data of stream %s", ch.streamID))
+				ch.closeChannel()
+				delete(channels, id)
+			} else if ch.unacked >= ackFrames {
+				ch.ackPending()
+			}
+			// Acknowledge all streams once the client paused
+			if stream.reader.Buffered() == 0 {
+				for _, ch := range channels {
+					ch.ackPending()
+				}
+			}
+			continue
+		case "INIT":
+			if channels[id] != nil {
+				stream.writeMessage(tagChannel("ERR 500 Channel already in use", id))
+				continue
+			}
+			ch := stream.newChannel(id)
+			if len(args) < 2 {
+				ch.respond("ERR 500 Missing arguments for " + cmd)
+				continue
+			}
+			host, file, valid := ch.checkSource(args[1], args[2:])
+			if !valid {
+				continue
+			}
+			if args[0] != "STREAM" {
+				ch.respond("ERR 500 Only streams are supported within a session")
+				continue
+			}
+			if !ch.initStream(host, file, args[2:], cmdIdx) {
+				continue
+			}
+			metricClientsActive.Inc()
+			channels[id] = ch
+		case "CLOSE":
+			if ch := channels[id]; ch != nil {
+				ch.closeChannel()
+				delete(channels, id)
+			}
+		default:
+			stream.writeMessage(tagChannel("ERR 500 Unknown command "+cmd, id))
+		}
+		cmdIdx = cmdIdx + 1
+	}
+}
+
+// newChannel returns a stream within the session of the connection
+func (stream *ServerLogStream) newChannel(id string) *ServerLogStream {
+	source := *stream.LogStream
+	source.streamID = stream.streamID + "-" + id
+	return &ServerLogStream{LogStream: &source, server: stream.server, token: stream.token, channel: id}
+}
+
+// closeChannel ends a stream within a session
+func (stream *ServerLogStream) closeChannel() {
+	stream.finish()
+	stream.server.releaseSink(stream.sink)
+	stream.sink = nil
+	metricClientsActive.Dec()
+	log.Info().Str("stream", stream.streamID).Msg("Stream of session closed")
+}
@@ -0,0 +1,185 @@
+package loghamster
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Default size of spool files to rotate at
+const defaultSpoolSize = 16 * 1024 * 1024
+
+// spool writes data received by an input to a spool file per source, which
+// is sent by a stream like any other input file. A spool file is rotated
+// once it reached the size and its checkpoint covers all of it, and the
+// rotated file is removed after the stream switched to the new file. Until
+// then the spool file keeps growing, so no data is lost while the server is
+// unavailable.
+type spool struct {
+	dir   string
+	size  int64
+	state *StateFile // Checkpoints of the streams of the spool files
+	mutex sync.Mutex
+	files map[string]*spoolFile
+}
+
+// spoolFile is the open spool file of a source
+type spoolFile struct {
+	path string
+	file *os.File
+	id   fileID
+	size int64
+}
+
+// newSpool creates the spool directory, spool files are rotated at the
+// size (or the default size)
+func newSpool(dir string, size int64, state *StateFile) (*spool, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		size = defaultSpoolSize
+	}
+	return &spool{dir: dir, size: size, state: state, files: map[string]*spoolFile{}}, nil
+}
+
+// path returns the path of the spool file of the source
+func (s *spool) path(source string) string {
+	return filepath.Join(s.dir, source+".log")
+}
+
+// sources returns the sources of spool files already in the spool
+// directory, like the files of a previous run with data not sent yet
+func (s *spool) sources() []string {
+	paths, _ := filepath.Glob(filepath.Join(s.dir, "*.log"))
+	sources := []string{}
+	for _, path := range paths {
+		sources = append(sources, strings.TrimSuffix(filepath.Base(path), ".log"))
+	}
+	return sources
+}
+
+// write appends the data to the spool file of the source and returns the
+// path of the file and true if the file was not written to before
+func (s *spool) write(source string, data []byte) (string, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f := s.files[source]
+	opened := f == nil
+	if opened {
+		var err error
+		if f, err = openSpoolFile(s.path(source)); err != nil {
+			return "", false, err
+		}
+		s.files[source] = f
+	}
+	if f.size >= s.size && s.sent(f) {
+		if err := f.rotate(); err != nil {
+			log.Warn().Err(err).Str("path", f.path).Msg("Failed to rotate spool file")
+		}
+	}
+	n, err := f.file.Write(data)
+	f.size = f.size + int64(n)
+	return f.path, opened, err
+}
+
+// sent returns true if the checkpoint of the stream covers all data of the
+// spool file, so it may be rotated
+func (s *spool) sent(f *spoolFile) bool {
+	if s.state == nil {
+		return true
+	}
+	checkpoint, ok := s.state.Get(f.path)
+	return ok && checkpoint.Offset >= f.size && fileID{Device: checkpoint.Device, Inode: checkpoint.Inode} == f.id
+}
+
+// pending returns the size of the data of the spool files of the source
+// not sent yet
+func (s *spool) pending(source string) int64 {
+	s.mutex.Lock()
+	size, id := int64(0), fileID{}
+	if f := s.files[source]; f != nil {
+		size, id = f.size, f.id
+	}
+	s.mutex.Unlock()
+	rotatedSize, rotatedID := int64(0), fileID{}
+	if info, err := os.Stat(rotatedSpoolPath(s.path(source))); err == nil {
+		rotatedSize, rotatedID = info.Size(), getFileID(info)
+	}
+	if s.state == nil {
+		return size + rotatedSize
+	}
+	checkpoint, _ := s.state.Get(s.path(source))
+	switch (fileID{Device: checkpoint.Device, Inode: checkpoint.Inode}) {
+	case id:
+		// The rotated file was sent, it is removed after the switch
+		return size - checkpoint.Offset
+	case rotatedID:
+		return rotatedSize - checkpoint.Offset + size
+	}
+	return size + rotatedSize
+}
+
+// drained returns true if all data of the spool files of the source was
+// sent, including data left by a previous run
+func (s *spool) drained(source string) bool {
+	path := s.path(source)
+	if _, err := os.Stat(rotatedSpoolPath(path)); !os.IsNotExist(err) {
+		return false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	return s.sent(&spoolFile{path: path, id: getFileID(info), size: info.Size()})
+}
+
+// openSpoolFile opens the spool file for appending
+func openSpoolFile(path string) (*spoolFile, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &spoolFile{path: path, file: file, id: getFileID(info), size: info.Size()}, nil
+}
+
+// rotate moves the spool file away and continues with a new file, unless
+// the stream did not switch from the file rotated before yet
+func (f *spoolFile) rotate() error {
+	rotated := rotatedSpoolPath(f.path)
+	if _, err := os.Stat(rotated); !os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+	next, err := openSpoolFile(f.path)
+	if err != nil {
+		return err
+	}
+	f.file.Close()
+	*f = *next
+	log.Debug().Str("path", f.path).Msg("Rotated spool file")
+	return nil
+}
+
+// rotatedSpoolPath returns the path of the spool file after rotation
+func rotatedSpoolPath(path string) string {
+	return path + ".1"
+}
+
+// removeRotatedSpool removes the rotated spool file after it was sent
+func removeRotatedSpool(path string) {
+	rotated := rotatedSpoolPath(path)
+	if err := os.Remove(rotated); err != nil && !os.IsNotExist(err) {
+		log.Warn().Err(err).Str("path", rotated).Msg("Failed to remove rotated spool file")
+	}
+}
@@ -0,0 +1,171 @@
+package loghamster
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// StreamState holds the persisted checkpoint for a single input
+type StreamState struct {
+	Path     string    `json:"path"`
+	Device   uint64    `json:"device"`
+	Inode    uint64    `json:"inode"`
+	Offset   int64     `json:"offset"`
+	LastRead time.Time `json:"lastRead"`
+
+	// Checksum of the first bytes of the file to detect truncation
+	Fingerprint     uint32 `json:"fingerprint"`
+	FingerprintSize int64  `json:"fingerprintSize"`
+
+	// File was sent completely (send after close)
+	Sent bool `json:"sent,omitempty"`
+}
+
+// StateFile keeps the checkpoints of all streams and persists them
+// atomically to disk, so a restarted client resumes where it stopped
+type StateFile struct {
+	Path    string
+	mutex   sync.Mutex
+	streams map[string]StreamState
+	dirty   bool // Checkpoints were set since the state file was written
+}
+
+// NewStateFile returns an empty state file for the given path. An empty
+// path disables persistence.
+func NewStateFile(path string) *StateFile {
+	return &StateFile{Path: path, streams: map[string]StreamState{}}
+}
+
+// Load reads all stream checkpoints from the state file. A missing
+// state file is not an error.
+func (state *StateFile) Load() error {
+	if state.Path == "" {
+		return nil
+	}
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	data, err := ioutil.ReadFile(state.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Info().Str("statefile", state.Path).Msg("No state file found, starting without checkpoints")
+			return nil
+		}
+		return err
+	}
+	var streams []StreamState
+	if err := json.Unmarshal(data, &streams); err != nil {
+		return err
+	}
+	for _, s := range streams {
+		state.streams[s.Path] = s
+	}
+	log.Info().Str("statefile", state.Path).Int("count", len(streams)).Msg("Loaded stream checkpoints from state file")
+	return nil
+}
+
+// Get returns the checkpoint for the given input path
+func (state *StateFile) Get(path string) (StreamState, bool) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	s, ok := state.streams[path]
+	return s, ok
+}
+
+// All returns the checkpoints of all streams
+func (state *StateFile) All() []StreamState {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	streams := make([]StreamState, 0, len(state.streams))
+	for _, s := range state.streams {
+		streams = append(streams, s)
+	}
+	return streams
+}
+
+// Update stores the checkpoint of a stream and writes the state file
+func (state *StateFile) Update(s StreamState) error {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.streams[s.Path] = s
+	return state.save()
+}
+
+// Set stores the checkpoint of a stream in memory, the state file is
+// written by the next Save
+func (state *StateFile) Set(s StreamState) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.streams[s.Path] = s
+	state.dirty = true
+}
+
+// Save writes the state file, if checkpoints were set since it was written
+func (state *StateFile) Save() error {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if !state.dirty {
+		return nil
+	}
+	return state.save()
+}
+
+// Remove drops the checkpoint of a stream and writes the state file
+func (state *StateFile) Remove(path string) error {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	delete(state.streams, path)
+	return state.save()
+}
+
+// save writes all checkpoints to a temporary file and renames it to the
+// state file, so a crash never leaves a partially written state behind
+func (state *StateFile) save() error {
+	if state.Path == "" {
+		return nil
+	}
+	streams := make([]StreamState, 0, len(state.streams))
+	for _, s := range state.streams {
+		streams = append(streams, s)
+	}
+	data, err := json.MarshalIndent(streams, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(state.Path)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(state.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), state.Path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	state.dirty = false
+	log.Trace().Str("statefile", state.Path).Int("count", len(streams)).Msg("Saved stream checkpoints to state file")
+	return nil
+}
@@ -0,0 +1,732 @@
+package loghamster
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+// Logical file names of the streams of a syslog input
+const (
+	SourceByProgram  = "program"  // Stream per program, messages without program by facility
+	SourceByFacility = "facility" // Stream per facility
+)
+
+const (
+	// Maximum size of a received syslog message
+	maxSyslogMessage = 64 * 1024
+	// Layout of the message time of lines written for syslog messages
+	syslogTimeLayout = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// Names of the syslog facilities by code
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// Control characters of messages written as escape sequences, like rsyslog
+var syslogEscaper = strings.NewReplacer("\n", "#012", "\r", "#015")
+
+// syslogMessage is a message received in RFC 3164 or RFC 5424 format
+type syslogMessage struct {
+	facility int
+	severity int
+	time     time.Time
+	host     string
+	program  string
+	pid      string
+	data     string // Structured data of RFC 5424 messages
+	msg      string
+}
+
+// parseSyslog parses a syslog message in RFC 5424 or RFC 3164 format, the
+// latter including the format of local messages sent to /dev/log without
+// hostname. Missing fields default to the receive time and facility user.
+func parseSyslog(data []byte, received time.Time) syslogMessage {
+	msg := strings.TrimRight(string(data), "\r\n\x00")
+	m := syslogMessage{facility: 1, severity: 5, time: received}
+	if end := strings.IndexByte(msg, '>'); strings.HasPrefix(msg, "<") && end > 1 && end <= 4 {
+		if pri, err := strconv.Atoi(msg[1:end]); err == nil && pri >= 0 && pri < len(syslogFacilities)*8 {
+			m.facility, m.severity = pri/8, pri%8
+			msg = msg[end+1:]
+		}
+	}
+	if strings.HasPrefix(msg, "1 ") {
+		m.parse5424(msg[2:])
+	} else {
+		m.parse3164(msg, received)
+	}
+	return m
+}
+
+// parse5424 parses the header fields, structured data and message of a
+// message in RFC 5424 format after the version
+func (m *syslogMessage) parse5424(msg string) {
+	fields := strings.SplitN(msg, " ", 6)
+	for len(fields) < 6 {
+		fields = append(fields, "")
+	}
+	if t, err := time.Parse(time.RFC3339Nano, fields[0]); err == nil {
+		m.time = t
+	}
+	m.host = nilValue(fields[1])
+	m.program = nilValue(fields[2])
+	m.pid = nilValue(fields[3])
+	rest := fields[5]
+	if strings.HasPrefix(rest, "[") {
+		end := structuredDataEnd(rest)
+		m.data, rest = rest[:end], rest[end:]
+	} else if rest == "-" || strings.HasPrefix(rest, "- ") {
+		rest = rest[1:]
+	}
+	m.msg = strings.TrimPrefix(strings.TrimPrefix(rest, " "), "\xef\xbb\xbf")
+}
+
+// parse3164 parses the timestamp, hostname and tag of a message in
+// RFC 3164 format. Besides the classic timestamp the RFC 3339 timestamp of
+// forwarding daemons is accepted.
+func (m *syslogMessage) parse3164(msg string, received time.Time) {
+	stamped := false
+	if len(msg) > len(time.Stamp) && msg[len(time.Stamp)] == ' ' {
+		if t, err := time.ParseInLocation(time.Stamp, msg[:len(time.Stamp)], time.Local); err == nil {
+			// The year is missing, a time far ahead was sent last year
+			m.time = time.Date(received.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local)
+			if m.time.After(received.Add(24 * time.Hour)) {
+				m.time = m.time.AddDate(-1, 0, 0)
+			}
+			msg, stamped = msg[len(time.Stamp)+1:], true
+		}
+	} else if sp := strings.IndexByte(msg, ' '); sp > 0 {
+		if t, err := time.Parse(time.RFC3339Nano, msg[:sp]); err == nil {
+			m.time = t
+			msg, stamped = msg[sp+1:], true
+		}
+	}
+	// Local messages have no hostname, the tag follows the timestamp. A word
+	// is only taken as hostname if a tag follows, "cron started" has neither.
+	if token, rest := splitToken(msg); stamped && token != "" && !isSyslogTag(token) {
+		if tag, _ := splitToken(rest); isSyslogTag(tag) {
+			m.host, msg = token, rest
+		}
+	}
+	if token, rest := splitToken(msg); isSyslogTag(token) {
+		tag := strings.TrimSuffix(token, ":")
+		if i := strings.IndexByte(tag, '['); i > 0 {
+			m.pid = strings.TrimSuffix(tag[i+1:], "]")
+			tag = tag[:i]
+		}
+		m.program, msg = tag, rest
+	}
+	m.msg = msg
+}
+
+// splitToken returns the first word of the message and the rest after the
+// space
+func splitToken(msg string) (string, string) {
+	if sp := strings.IndexByte(msg, ' '); sp >= 0 {
+		return msg[:sp], msg[sp+1:]
+	}
+	return msg, ""
+}
+
+// isSyslogTag returns true if the word is a tag like "sshd:" or "sshd[42]:"
+func isSyslogTag(token string) bool {
+	return len(token) > 1 && len(token) <= 48 && strings.HasSuffix(token, ":")
+}
+
+// nilValue returns the value of a header field of RFC 5424, empty for "-"
+func nilValue(value string) string {
+	if value == "-" {
+		return ""
+	}
+	return value
+}
+
+// structuredDataEnd returns the end of the structured data elements at the
+// start of the message, like [id key="value"][id2 key="\]"]
+func structuredDataEnd(msg string) int {
+	quoted, escaped := false, false
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == ']' && !quoted && (i+1 == len(msg) || msg[i+1] != '['):
+			return i + 1
+		}
+	}
+	return len(msg)
+}
+
+// facilityName returns the name of the facility of the message
+func (m syslogMessage) facilityName() string {
+	if m.facility >= 0 && m.facility < len(syslogFacilities) {
+		return syslogFacilities[m.facility]
+	}
+	return "user"
+}
+
+// source returns the logical name of the stream of the message, the
+// program (if set) or the facility
+func (m syslogMessage) source(by string) string {
+	if by != SourceByFacility {
+		if name := sanitizeSource(filepath.Base(m.program)); name != "" {
+			return name
+		}
+	}
+	return m.facilityName()
+}
+
+// sanitizeSource returns the name with characters not allowed in a file
+// name replaced, empty if nothing is left
+func sanitizeSource(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+	return strings.TrimLeft(name, ".")
+}
+
+// line returns the message as a line like written by syslog daemons:
+// time host program[pid]: message
+func (m syslogMessage) line() []byte {
+	var b strings.Builder
+	b.WriteString(m.time.Format(syslogTimeLayout))
+	b.WriteString(" ")
+	b.WriteString(m.host)
+	if m.program != "" {
+		b.WriteString(" ")
+		b.WriteString(m.program)
+		if m.pid != "" {
+			b.WriteString("[" + m.pid + "]")
+		}
+		b.WriteString(":")
+	}
+	if m.data != "" {
+		b.WriteString(" ")
+		b.WriteString(m.data)
+	}
+	if m.msg != "" {
+		b.WriteString(" ")
+		b.WriteString(syslogEscaper.Replace(m.msg))
+	}
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+// parseListen returns the network and address of a syslog listener like
+// udp://0.0.0.0:514, tcp://127.0.0.1:601, tls://0.0.0.0:6514 or
+// unix:///dev/log. Without a scheme UDP is used.
+func parseListen(listen string) (string, string, error) {
+	scheme, address := "udp", listen
+	if i := strings.Index(listen, "://"); i >= 0 {
+		scheme, address = listen[:i], listen[i+3:]
+	}
+	if address == "" {
+		return "", "", fmt.Errorf("missing address to listen on")
+	}
+	switch scheme {
+	case "udp", "tcp", "tls":
+		return scheme, address, nil
+	case "unix":
+		return "unixgram", address, nil
+	}
+	return "", "", fmt.Errorf("unknown network %s to listen on", scheme)
+}
+
+// syslogReceiver writes the received messages of a syslog input to the
+// spool files of their sources and starts a stream for each source. Once
+// the spool files of a source hold the maximum size of data not sent,
+// messages of the source are dropped, like data of named pipes.
+type syslogReceiver struct {
+	client   *Client
+	input    InputFile
+	spool    *spool
+	maxSpool int64
+	messages *metrics.Counter
+	dropped  *metrics.Counter
+	mutex    sync.Mutex
+	skipped  map[string]int64 // Bytes dropped by source since the last message spooled, guarded by the mutex
+}
+
+// ListenSyslog receives syslog messages for the input over UDP, TCP or a
+// unix datagram socket. The messages are written as lines to spool files
+// by program or facility, which are streamed with the logical file name
+// <input name>/<program or facility>.
+func (client *Client) ListenSyslog(input InputFile) {
+	network, address, err := parseListen(input.Listen)
+	if err != nil {
+		log.Error().Err(err).Str("name", input.Name).Str("listen", input.Listen).Msg("Invalid syslog listener of input")
+		return
+	}
+	size, err := parseSize(input.SpoolSize)
+	if err != nil {
+		log.Error().Err(err).Str("name", input.Name).Str("spoolsize", input.SpoolSize).Msg("Invalid spool size of input")
+		return
+	}
+	maxSpool, err := parseSize(input.MaxSpool)
+	if err != nil {
+		log.Error().Err(err).Str("name", input.Name).Str("maxspool", input.MaxSpool).Msg("Invalid maximum spool size of input")
+		return
+	}
+	if maxSpool <= 0 {
+		maxSpool = defaultMaxSpool
+	}
+	if network == "tls" {
+		log.Error().Str("name", input.Name).Str("listen", input.Listen).Msg("Syslog over TLS is only received by the server")
+		return
+	}
+	spool, err := newSpool(filepath.Join(input.SpoolDir, input.Name), size, client.state)
+	if err != nil {
+		log.Error().Err(err).Str("name", input.Name).Str("spooldir", input.SpoolDir).Msg("Failed to create spool directory of input")
+		return
+	}
+	// Messages are written as complete lines, but may be read while written
+	input.Lines = true
+	receiver := &syslogReceiver{client: client, input: input, spool: spool, maxSpool: maxSpool, skipped: map[string]int64{}}
+	receiver.messages = metrics.GetOrCreateCounter(fmt.Sprintf(`loghamster_syslog_messages_total{input="%s"}`, escapeLabelValue(input.Name)))
+	receiver.dropped = metrics.GetOrCreateCounter(fmt.Sprintf(`loghamster_input_dropped_bytes_total{input="%s"}`, escapeLabelValue(input.Name)))
+	if client.WatchDir != nil {
+		if err := client.WatchDir(spool.dir); err != nil {
+			log.Error().Err(err).Str("dir", spool.dir).Msg("Failed to watch spool dir of input")
+		}
+	}
+	// Send the data left in the spool by a previous run
+	for _, source := range spool.sources() {
+		receiver.startStream(source, spool.path(source))
+	}
+
+	log.Info().Str("name", input.Name).Str("network", network).Str("address", address).Msg("Listening for syslog messages")
+	if network == "tcp" {
+		err = receiver.listenStream(address)
+	} else {
+		err = receiver.listenPacket(network, address)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("name", input.Name).Str("listen", input.Listen).Msg("Syslog listener of input failed")
+	}
+}
+
+// startStream starts the stream of the spool file of the source
+func (receiver *syslogReceiver) startStream(source string, path string) {
+	receiver.client.startStream(receiver.input, path, receiver.input.Name+"/"+source)
+}
+
+// listenPacket receives a message per datagram
+func (receiver *syslogReceiver) listenPacket(network string, address string) error {
+	if network == "unixgram" {
+		// A socket left over by a previous run is replaced
+		if info, err := os.Lstat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if network == "unixgram" {
+		// Any local process may log, like to /dev/log
+		if err := os.Chmod(address, 0666); err != nil {
+			log.Warn().Err(err).Str("path", address).Msg("Failed to allow writing to syslog socket")
+		}
+	}
+	buf := make([]byte, maxSyslogMessage)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		receiver.receive(buf[:n])
+	}
+}
+
+// listenStream accepts TCP connections of syslog senders
+func (receiver *syslogReceiver) listenStream(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go receiver.handleConn(conn)
+	}
+}
+
+// handleConn receives the messages of a TCP connection until it is closed
+func (receiver *syslogReceiver) handleConn(conn net.Conn) {
+	defer conn.Close()
+	log.Debug().Str("name", receiver.input.Name).Str("remote", conn.RemoteAddr().String()).Msg("Syslog sender connected")
+	reader := bufio.NewReaderSize(conn, maxSyslogMessage)
+	for {
+		data, err := readSyslogFrame(reader)
+		if len(data) > 0 {
+			receiver.receive(data)
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Warn().Err(err).Str("name", receiver.input.Name).Str("remote", conn.RemoteAddr().String()).Msg("Closing syslog connection")
+			}
+			return
+		}
+	}
+}
+
+// readSyslogFrame reads a message sent over TCP with octet counting
+// (RFC 6587, like "12 <13>message") or terminated by a line break
+func readSyslogFrame(reader *bufio.Reader) ([]byte, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] < '0' || first[0] > '9' {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return nil, fmt.Errorf("message exceeds %d bytes", maxSyslogMessage)
+		}
+		return append([]byte{}, line...), err
+	}
+	count, err := reader.ReadSlice(' ')
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(strings.TrimSuffix(string(count), " "))
+	if err != nil || length > maxSyslogMessage {
+		return nil, fmt.Errorf("invalid message length %q", count)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// receive parses the message and writes it to the spool file of its
+// source, starting the stream of a new source. The message is dropped if
+// the spool of the source is full, the next message spooled is preceded by
+// a line with the number of bytes dropped.
+func (receiver *syslogReceiver) receive(data []byte) {
+	m := parseSyslog(data, time.Now())
+	if m.host == "" {
+		m.host = receiver.client.Hostname
+	}
+	source := m.source(receiver.input.SourceBy)
+	line := m.line()
+
+	if pending := receiver.spool.pending(source); pending > 0 && pending+int64(len(line)) > receiver.maxSpool {
+		receiver.mutex.Lock()
+		if receiver.skipped[source] == 0 {
+			log.Warn().Str("name", receiver.input.Name).Str("source", source).Int64("maxspool", receiver.maxSpool).Msg("Spool of syslog source full, dropping messages")
+		}
+		receiver.skipped[source] = receiver.skipped[source] + int64(len(line))
+		receiver.mutex.Unlock()
+		receiver.dropped.Add(len(line))
+		return
+	}
+	receiver.mutex.Lock()
+	dropped := receiver.skipped[source]
+	delete(receiver.skipped, source)
+	receiver.mutex.Unlock()
+	if dropped > 0 {
+		log.Warn().Str("name", receiver.input.Name).Str("source", source).Int64("dropped", dropped).Msg("Dropped syslog messages of source")
+		line = append([]byte(fmt.Sprintf("loghamster: dropped %d bytes of input %s\n", dropped, receiver.input.Name)), line...)
+	}
+	path, opened, err := receiver.spool.write(source, line)
+	if err != nil {
+		log.Error().Err(err).Str("name", receiver.input.Name).Str("source", source).Msg("Failed to spool syslog message")
+		receiver.dropped.Add(len(line))
+		return
+	}
+	receiver.messages.Inc()
+	if opened {
+		// Connecting the stream must not block receiving messages
+		go receiver.startStream(source, path)
+	}
+}
+
+const (
+	// Time after which the output of an idle syslog source is closed
+	syslogIdleTimeout = 10 * time.Minute
+	// Maximum number of syslog sources of the server, including sources not
+	// mapped to an output, as hostnames of messages are not verified
+	maxSyslogSources = 10000
+)
+
+// syslogServer writes syslog messages received by the server, like
+// forwarded by rsyslog, to the outputs of their sources. A source is the
+// host and program of messages, mapped like the streams of clients with
+// the logical file name <name>/<program>.
+type syslogServer struct {
+	server   *Server
+	name     string // Input name of the sources and directory of their file names
+	messages *metrics.Counter
+	mutex    sync.Mutex
+	sources  map[string]*syslogSource // By host:file
+	rejected map[string]time.Time     // Last message by host:file of sources not mapped to an output
+	full     bool                     // Messages of new sources are dropped
+}
+
+// syslogSource is the stream of a source mapped to an output, messages of
+// a source are written one at a time
+type syslogSource struct {
+	mutex    sync.Mutex
+	stream   *ServerLogStream
+	lastSeen time.Time // Guarded by the mutex of the server
+}
+
+// listenSyslog receives syslog messages on all addresses configured for
+// the server over UDP (RFC 5426), TCP (RFC 6587) or TLS (RFC 5425)
+func (server *Server) listenSyslog() error {
+	config := server.config
+	if len(config.Syslog) == 0 {
+		return nil
+	}
+	receiver := &syslogServer{server: server, name: config.SyslogName, sources: map[string]*syslogSource{}, rejected: map[string]time.Time{}}
+	if receiver.name == "" {
+		receiver.name = "syslog"
+	}
+	receiver.messages = metrics.GetOrCreateCounter(fmt.Sprintf(`loghamster_syslog_messages_total{input="%s"}`, escapeLabelValue(receiver.name)))
+	for _, listen := range config.Syslog {
+		network, address, err := parseListen(listen)
+		if err != nil {
+			return err
+		}
+		if config.Auth.Enabled && network != "tls" {
+			log.Warn().Str("network", network).Str("address", address).Msg("Syslog senders are not authenticated, hostnames of messages are not verified")
+		}
+		switch network {
+		case "udp":
+			conn, err := net.ListenPacket(network, address)
+			if err != nil {
+				return err
+			}
+			server.syslogClosers = append(server.syslogClosers, conn)
+			go receiver.receivePackets(conn)
+		case "tcp", "tls":
+			l, err := net.Listen("tcp", address)
+			if err != nil {
+				return err
+			}
+			if network == "tls" {
+				// Syslog senders can't authenticate with tokens, only by certificate
+				if config.Auth.Enabled && !config.TLS.RequireClientCert {
+					l.Close()
+					return fmt.Errorf("syslog over TLS requires client certificates (requireClientCert) with authentication enabled")
+				}
+				tlsConfig, err := NewServerTLSConfig(config.TLS)
+				if err != nil {
+					l.Close()
+					return err
+				}
+				l = tls.NewListener(l, tlsConfig)
+			}
+			server.syslogClosers = append(server.syslogClosers, l)
+			go receiver.acceptConnections(l)
+		default:
+			return fmt.Errorf("network %s not supported for syslog of server", network)
+		}
+		log.Info().Str("network", network).Str("address", address).Msg("Listening for syslog messages")
+	}
+	go receiver.closeIdle()
+	return nil
+}
+
+// receivePackets receives a message per datagram
+func (receiver *syslogServer) receivePackets(conn net.PacketConn) {
+	buf := make([]byte, maxSyslogMessage)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to receive syslog messages")
+			return
+		}
+		receiver.receive(buf[:n], addr, nil)
+	}
+}
+
+// acceptConnections accepts connections of syslog senders
+func (receiver *syslogServer) acceptConnections(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to accept syslog connections")
+			return
+		}
+		go receiver.handleConn(conn)
+	}
+}
+
+// handleConn receives the messages of a connection until it is closed
+func (receiver *syslogServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	if err := handshakeTLS(conn); err != nil {
+		log.Warn().Err(err).Str("remote", conn.RemoteAddr().String()).Msg("TLS handshake of syslog sender failed")
+		metricTLSHandshakeFailuresTotal.Inc()
+		return
+	}
+	log.Debug().Str("remote", conn.RemoteAddr().String()).Msg("Syslog sender connected")
+	allowed := receiver.hostCheck(conn)
+	reader := bufio.NewReaderSize(conn, maxSyslogMessage)
+	for {
+		data, err := readSyslogFrame(reader)
+		if len(data) > 0 {
+			receiver.receive(data, conn.RemoteAddr(), allowed)
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Warn().Err(err).Str("remote", conn.RemoteAddr().String()).Msg("Closing syslog connection")
+			}
+			return
+		}
+	}
+}
+
+// hostCheck returns the check of the HOSTNAME of messages received over
+// TLS against the certificate of the sender, like the hostname claimed by
+// clients. The result for the last hostname is kept, as senders usually
+// send a single one. Senders over UDP and TCP are not verified (nil).
+func (receiver *syslogServer) hostCheck(conn net.Conn) func(host string) bool {
+	if _, ok := conn.(*tls.Conn); !ok {
+		return nil
+	}
+	var last string
+	var allowed bool
+	return func(host string) bool {
+		if host != last {
+			last, allowed = host, receiver.server.isHostAllowed(conn, host)
+		}
+		return allowed
+	}
+}
+
+// receive writes the message to the output of its source, messages
+// without hostname are assigned to the address of the sender. The HOSTNAME
+// of the message must be allowed, if checked.
+func (receiver *syslogServer) receive(data []byte, addr net.Addr, allowed func(host string) bool) {
+	m := parseSyslog(data, time.Now())
+	if m.host != "" && allowed != nil && !allowed(m.host) {
+		metricHostsRejectedTotal.Inc()
+		return
+	}
+	if m.host == "" {
+		m.host = addr.String()
+		if host, _, err := net.SplitHostPort(m.host); err == nil {
+			m.host = host
+		}
+	}
+	file := receiver.name + "/" + m.source(SourceByProgram)
+	line := m.line()
+	receiver.messages.Inc()
+
+	source := receiver.source(m.host, file)
+	if source == nil {
+		return
+	}
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	stream := source.stream
+	n, err := stream.writeData(frameHeader{offset: stream.next, records: []int{1}}, line)
+	metricBytesRecvTotal.Add(n)
+	metricRecordsRecvTotal.Inc()
+	stream.received.Add(n)
+	stream.next = stream.next + int64(len(line))
+	if err != nil {
+		log.Error().Err(err).Str("host", m.host).Str("file", file).Str("localfile", stream.sink.Name()).Msg("Failed to write syslog message")
+	}
+}
+
+// source returns the source of the host and file, mapped to its output on
+// the first message. It returns nil for sources not mapped to an output,
+// which are only remembered as rejected until they were idle, and for new
+// sources once the maximum number of sources was reached.
+func (receiver *syslogServer) source(host string, file string) *syslogSource {
+	key := host + ":" + file
+	now := time.Now()
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	if source := receiver.sources[key]; source != nil {
+		source.lastSeen = now
+		return source
+	}
+	if _, ok := receiver.rejected[key]; ok {
+		receiver.rejected[key] = now
+		return nil
+	}
+	if len(receiver.sources)+len(receiver.rejected) >= maxSyslogSources {
+		if !receiver.full {
+			log.Warn().Int("sources", maxSyslogSources).Str("host", host).Str("file", file).Msg("Too many syslog sources, dropping messages of new sources")
+			receiver.full = true
+		}
+		metricStreamsRejectedTotal.Inc()
+		return nil
+	}
+	stream := &ServerLogStream{LogStream: &LogStream{streamID: generateStreamID()}, server: receiver.server, meta: map[string]string{"name": receiver.name}}
+	if err := stream.initStreamSink(host, file); err != nil {
+		log.Warn().Err(err).Str("host", host).Str("file", file).Msg("Dropping syslog messages of source without output")
+		metricStreamsRejectedTotal.Inc()
+		receiver.rejected[key] = now
+		return nil
+	}
+	stream.received = streamCounter("loghamster_stream_bytes_received_total", host, stream.meta, receiver.server.config.MetricLabels)
+	log.Info().Str("stream", stream.streamID).Str("host", host).Str("file", file).Str("localfile", stream.sink.Name()).Msg("Writing syslog messages of source to file")
+	source := &syslogSource{stream: stream, lastSeen: now}
+	receiver.sources[key] = source
+	return source
+}
+
+// closeIdle closes the outputs of sources without messages for a while
+func (receiver *syslogServer) closeIdle() {
+	for {
+		time.Sleep(time.Minute)
+		receiver.mutex.Lock()
+		for key, source := range receiver.sources {
+			if time.Since(source.lastSeen) < syslogIdleTimeout {
+				continue
+			}
+			// Wait for a message of the source being written
+			source.mutex.Lock()
+			source.stream.finish()
+			receiver.server.releaseSink(source.stream.sink)
+			source.mutex.Unlock()
+			log.Info().Str("stream", source.stream.streamID).Str("source", key).Msg("Closed idle syslog source")
+			delete(receiver.sources, key)
+		}
+		for key, seen := range receiver.rejected {
+			if time.Since(seen) >= syslogIdleTimeout {
+				delete(receiver.rejected, key)
+			}
+		}
+		receiver.full = len(receiver.sources)+len(receiver.rejected) >= maxSyslogSources
+		receiver.mutex.Unlock()
+	}
+}
@@ -0,0 +1,179 @@
+package loghamster
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+func TestParseSyslog(t *testing.T) {
+	received := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		data string
+		want syslogMessage
+	}{
+		{
+			"<38>Oct 17 01:02:03 web1 sshd[42]: Accepted key",
+			syslogMessage{facility: 4, severity: 6, time: time.Date(2026, 10, 17, 1, 2, 3, 0, time.Local), host: "web1", program: "sshd", pid: "42", msg: "Accepted key"},
+		},
+		{
+			// Local message without hostname
+			"<13>Oct 17 01:02:03 app: started\n",
+			syslogMessage{facility: 1, severity: 5, time: time.Date(2026, 10, 17, 1, 2, 3, 0, time.Local), program: "app", msg: "started"},
+		},
+		{
+			// Neither hostname nor tag
+			"<13>Oct 17 01:02:03 cron started",
+			syslogMessage{facility: 1, severity: 5, time: time.Date(2026, 10, 17, 1, 2, 3, 0, time.Local), msg: "cron started"},
+		},
+		{
+			// Hostname followed by a tag without message
+			"<13>Oct 17 01:02:03 web1 app:",
+			syslogMessage{facility: 1, severity: 5, time: time.Date(2026, 10, 17, 1, 2, 3, 0, time.Local), host: "web1", program: "app"},
+		},
+		{
+			// Sent last year
+			"<13>Dec 31 23:59:59 web1 app: late",
+			syslogMessage{facility: 1, severity: 5, time: time.Date(2025, 12, 31, 23, 59, 59, 0, time.Local), host: "web1", program: "app", msg: "late"},
+		},
+		{
+			"<13>2026-10-17T01:02:03.5Z web1 app[7]: forwarded",
+			syslogMessage{facility: 1, severity: 5, time: time.Date(2026, 10, 17, 1, 2, 3, 500000000, time.UTC), host: "web1", program: "app", pid: "7", msg: "forwarded"},
+		},
+		{
+			"<165>1 2026-10-17T01:02:03Z web1 nginx 5 ID47 [ex@1 a=\"b\\]\"] message",
+			syslogMessage{facility: 20, severity: 5, time: time.Date(2026, 10, 17, 1, 2, 3, 0, time.UTC), host: "web1", program: "nginx", pid: "5", data: "[ex@1 a=\"b\\]\"]", msg: "message"},
+		},
+		{
+			"<14>1 - - - - - - \xef\xbb\xbfnil values",
+			syslogMessage{facility: 1, severity: 6, time: received, msg: "nil values"},
+		},
+		{
+			"no header at all",
+			syslogMessage{facility: 1, severity: 5, time: received, msg: "no header at all"},
+		},
+		{
+			"<999>invalid priority",
+			syslogMessage{facility: 1, severity: 5, time: received, msg: "<999>invalid priority"},
+		},
+	}
+	for _, test := range tests {
+		m := parseSyslog([]byte(test.data), received)
+		if !m.time.Equal(test.want.time) {
+			t.Errorf("%q: time %v, want %v", test.data, m.time, test.want.time)
+		}
+		m.time, test.want.time = time.Time{}, time.Time{}
+		if m != test.want {
+			t.Errorf("%q: got %+v, want %+v", test.data, m, test.want)
+		}
+	}
+}
+
+func TestSyslogMessageSource(t *testing.T) {
+	tests := []struct {
+		m    syslogMessage
+		by   string
+		want string
+	}{
+		{syslogMessage{facility: 4, program: "sshd"}, SourceByProgram, "sshd"},
+		{syslogMessage{facility: 4, program: "sshd"}, SourceByFacility, "auth"},
+		{syslogMessage{facility: 9}, SourceByProgram, "cron"},
+		{syslogMessage{facility: 1, program: "/usr/bin/my prog"}, "", "my_prog"},
+		{syslogMessage{facility: 1, program: ".."}, "", "user"},
+		{syslogMessage{facility: 99}, "", "user"},
+	}
+	for _, test := range tests {
+		if got := test.m.source(test.by); got != test.want {
+			t.Errorf("%+v by %q: got %q, want %q", test.m, test.by, got, test.want)
+		}
+	}
+}
+
+func TestSyslogMessageLine(t *testing.T) {
+	m := syslogMessage{time: time.Date(2026, 10, 17, 1, 2, 3, 0, time.UTC), host: "web1", program: "app", pid: "7", msg: "two\nlines"}
+	if got, want := string(m.line()), "2026-10-17T01:02:03.000000Z web1 app[7]: two#012lines\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	tests := []struct {
+		data     string
+		messages []string
+		err      bool
+	}{
+		{"<13>one\n<13>two\n", []string{"<13>one\n", "<13>two\n"}, false},
+		{"7 <13>one8 <13>two\n", []string{"<13>one", "<13>two\n"}, false},
+		{"7 <13>one<13>two\n", []string{"<13>one", "<13>two\n"}, false},
+		{"<13>last without line break", []string{"<13>last without line break"}, false},
+		{"10 <13>short", nil, true},
+		{"x1 <13>", []string{"x1 <13>"}, false},
+		{"12a <13>", nil, true},
+		{"99999999 <13>", nil, true},
+		{"<13>" + strings.Repeat("x", maxSyslogMessage) + "\n", nil, true},
+	}
+	for _, test := range tests {
+		reader := bufio.NewReaderSize(strings.NewReader(test.data), maxSyslogMessage)
+		var messages []string
+		var err error
+		for {
+			var data []byte
+			data, err = readSyslogFrame(reader)
+			if len(data) > 0 {
+				messages = append(messages, string(data))
+			}
+			if err != nil {
+				break
+			}
+		}
+		if (err != io.EOF) != test.err {
+			t.Errorf("%.40q: got error %v", test.data, err)
+		}
+		if strings.Join(messages, "|") != strings.Join(test.messages, "|") {
+			t.Errorf("%.40q: got %q, want %q", test.data, messages, test.messages)
+		}
+	}
+}
+
+func TestParseListen(t *testing.T) {
+	tests := []struct {
+		listen  string
+		network string
+		address string
+		err     bool
+	}{
+		{"udp://0.0.0.0:514", "udp", "0.0.0.0:514", false},
+		{"tcp://127.0.0.1:601", "tcp", "127.0.0.1:601", false},
+		{"unix:///dev/log", "unixgram", "/dev/log", false},
+		{"sctp://host:1", "", "", true},
+	}
+	for _, test := range tests {
+		network, address, err := parseListen(test.listen)
+		if (err != nil) != test.err || network != test.network || address != test.address {
+			t.Errorf("%q: got %q %q %v", test.listen, network, address, err)
+		}
+	}
+}
+
+func TestSyslogHostNotAllowed(t *testing.T) {
+	receiver := &syslogServer{server: &Server{}, name: "syslog", sources: map[string]*syslogSource{}, rejected: map[string]time.Time{}}
+	receiver.messages = metrics.GetOrCreateCounter(`loghamster_syslog_messages_total{input="test"}`)
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 6514}
+	allowed := func(host string) bool { return host == "web1" }
+	receiver.receive([]byte("<13>Oct 17 01:02:03 db1 app: claimed"), addr, allowed)
+	if len(receiver.sources)+len(receiver.rejected) != 0 {
+		t.Errorf("message of host not allowed written to %v", receiver.sources)
+	}
+}
+
+func TestSyslogTLSRequiresClientCert(t *testing.T) {
+	server := &Server{config: ServerConfig{Syslog: []string{"tls://127.0.0.1:0"}, Auth: AuthConfig{Enabled: true}}}
+	if err := server.listenSyslog(); err == nil {
+		t.Error("expected error for syslog over TLS without client certificates")
+	}
+}
@@ -0,0 +1,95 @@
+package loghamster
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// templateVarPattern matches $NAME and ${NAME} placeholders in templates
+var templateVarPattern = regexp.MustCompile(`\$\{([A-Za-z0-9_]+)\}|\$([A-Za-z][A-Za-z0-9_]*)`)
+
+// templateVars holds the values of placeholders to expand in a template
+type templateVars struct {
+	host     string
+	file     string
+	streamID string
+	meta     map[string]string
+	time     time.Time
+}
+
+// lookup returns the value for a placeholder. Builtin placeholders are
+// uppercase, other names are looked up in the stream metadata.
+func (vars templateVars) lookup(name string) string {
+	file := strings.TrimPrefix(filepath.Clean("/"+vars.file), "/")
+	switch name {
+	case "HOST":
+		return sanitizePathElement(vars.host)
+	case "FILE":
+		return file
+	case "DIR":
+		return strings.TrimPrefix(filepath.Dir("/"+file), "/")
+	case "BASENAME":
+		return sanitizePathElement(filepath.Base(file))
+	case "NAME":
+		if name, ok := vars.meta["name"]; ok && name != "" {
+			return sanitizePathElement(name)
+		}
+		base := filepath.Base(file)
+		return sanitizePathElement(strings.TrimSuffix(base, filepath.Ext(base)))
+	case "STREAMID":
+		return sanitizePathElement(vars.streamID)
+	case "YYYY":
+		return vars.time.Format("2006")
+	case "MM":
+		return vars.time.Format("01")
+	case "DD":
+		return vars.time.Format("02")
+	case "HH":
+		return vars.time.Format("15")
+	}
+	if value, ok := vars.meta[name]; ok {
+		return sanitizePathElement(value)
+	}
+	return sanitizePathElement(vars.meta[strings.ToLower(name)])
+}
+
+// expandPathTemplate replaces all placeholders in the template, like
+// $HOST/$YYYY/$MM/${BASENAME}.log. The expanded path never leaves the
+// base directory, as values with path separators are sanitized.
+func expandPathTemplate(template string, vars templateVars) string {
+	return templateVarPattern.ReplaceAllStringFunc(template, func(match string) string {
+		name := strings.Trim(match, "${}")
+		return vars.lookup(name)
+	})
+}
+
+// isDatedTemplate returns true if the template contains placeholders of
+// the current date or hour
+func isDatedTemplate(template string) bool {
+	for _, match := range templateVarPattern.FindAllStringSubmatch(template, -1) {
+		switch match[1] + match[2] {
+		case "YYYY", "MM", "DD", "HH":
+			return true
+		}
+	}
+	return false
+}
+
+// nextHour returns the start of the hour after the time, when the path of
+// a dated template changes at the earliest
+func nextHour(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+}
+
+// sanitizePathElement makes a value safe to be used as a single element
+// of a path
+func sanitizePathElement(value string) string {
+	value = strings.Replace(value, "/", "_", -1)
+	value = strings.Replace(value, "\\", "_", -1)
+	if value == "." || value == ".." {
+		return "_"
+	}
+	return value
+}
@@ -0,0 +1,88 @@
+package loghamster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpandPathTemplate(t *testing.T) {
+	vars := templateVars{
+		host:     "web1",
+		file:     "/var/log/app/server.log",
+		streamID: "abc",
+		meta:     map[string]string{"svc": "shop", "env": "prod/eu"},
+		time:     time.Date(2026, 10, 7, 9, 30, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"$HOST/$FILE", "web1/var/log/app/server.log"},
+		{"${HOST}/${BASENAME}", "web1/server.log"},
+		{"$HOST/$DIR/$NAME.log", "web1/var/log/app/server.log"},
+		{"$YYYY/$MM/$DD/$HH/$STREAMID", "2026/10/07/09/abc"},
+		{"$svc/${SVC}.log", "shop/shop.log"},
+		{"$env/$missing/x", "prod_eu//x"},
+		{"no placeholders", "no placeholders"},
+		{"$$HOST", "$web1"},
+	}
+	for _, test := range tests {
+		if got := expandPathTemplate(test.template, vars); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.template, got, test.want)
+		}
+	}
+}
+
+func TestExpandPathTemplateSanitized(t *testing.T) {
+	tests := []struct {
+		vars     templateVars
+		template string
+		want     string
+	}{
+		{templateVars{host: "../etc"}, "$HOST/x", ".._etc/x"},
+		{templateVars{host: ".."}, "$HOST/x", "_/x"},
+		{templateVars{file: "../../etc/passwd"}, "$FILE", "etc/passwd"},
+		{templateVars{file: "a\\b"}, "$BASENAME", "a_b"},
+		{templateVars{file: "/x/y.log", meta: map[string]string{"name": "../n"}}, "$NAME", ".._n"},
+		{templateVars{file: "/x/y.log"}, "$NAME", "y"},
+	}
+	for _, test := range tests {
+		if got := expandPathTemplate(test.template, test.vars); got != test.want {
+			t.Errorf("%q with %+v: got %q, want %q", test.template, test.vars, got, test.want)
+		}
+	}
+}
+
+func TestIsDatedTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		dated    bool
+	}{
+		{"$HOST/$FILE", false},
+		{"$HOST/$YYYY/$FILE", true},
+		{"${HH}.log", true},
+		{"$MMX/$DDD", false},
+		{"$svc/$DD", true},
+	}
+	for _, test := range tests {
+		if dated := isDatedTemplate(test.template); dated != test.dated {
+			t.Errorf("%q: got %v, want %v", test.template, dated, test.dated)
+		}
+	}
+}
+
+func TestNextHour(t *testing.T) {
+	tests := []struct {
+		t    time.Time
+		want time.Time
+	}{
+		{time.Date(2026, 10, 7, 9, 30, 15, 5, time.UTC), time.Date(2026, 10, 7, 10, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 10, 7, 9, 0, 0, 0, time.UTC), time.Date(2026, 10, 7, 10, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 12, 31, 23, 59, 59, 0, time.UTC), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		if got := nextHour(test.t); !got.Equal(test.want) {
+			t.Errorf("%v: got %v, want %v", test.t, got, test.want)
+		}
+	}
+}
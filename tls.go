@@ -0,0 +1,184 @@
+package loghamster
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Timeout for the TLS handshake of a new connection
+const tlsHandshakeTimeout = 10 * time.Second
+
+// tlsVersion returns the TLS version for a version string like "1.2"
+func tlsVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %s", version)
+}
+
+// loadCertPool reads a PEM encoded CA bundle
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", path)
+	}
+	return pool, nil
+}
+
+// NewServerTLSConfig returns the TLS configuration for the server listener
+func NewServerTLSConfig(conf TLSConfig) (*tls.Config, error) {
+	version, err := tlsVersion(conf.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   version,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	if conf.CA != "" {
+		pool, err := loadCertPool(conf.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+	}
+	if conf.RequireClientCert {
+		if config.ClientCAs == nil {
+			return nil, fmt.Errorf("a CA bundle is required to verify client certificates")
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// NewClientTLSConfig returns the TLS configuration for client connections
+func NewClientTLSConfig(conf TLSConfig) (*tls.Config, error) {
+	version, err := tlsVersion(conf.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion: version,
+		ServerName: conf.ServerName,
+	}
+	if conf.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if conf.CA != "" {
+		pool, err := loadCertPool(conf.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// handshakeTLS completes the TLS handshake of a new connection, plain
+// connections are accepted unchanged
+func handshakeTLS(conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	err := tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	return err
+}
+
+// peerNames returns the common name and DNS names of the verified client
+// certificate, or nil if no client certificate was presented
+func peerNames(conn net.Conn) []string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := state.PeerCertificates[0]
+	names := []string{}
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return append(names, cert.DNSNames...)
+}
+
+// newHostPattern returns a pattern of hostnames allowed to be claimed.
+// Unlike the rules of outputs, a regex must match the whole hostname, so
+// ~web1 does not allow web10.
+func newHostPattern(raw string) (*pattern, error) {
+	if strings.HasPrefix(raw, "~") {
+		raw = "~^(?:" + raw[1:] + ")$"
+	}
+	return newPattern(raw)
+}
+
+// compileTLSHosts parses the hostname patterns allowed per client certificate name
+func compileTLSHosts(hosts map[string][]string) (map[string][]*pattern, error) {
+	compiled := map[string][]*pattern{}
+	for name, raws := range hosts {
+		for _, raw := range raws {
+			p, err := newHostPattern(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid host pattern %s for client certificate %s: %v", raw, name, err)
+			}
+			if p != nil {
+				compiled[name] = append(compiled[name], p)
+			}
+		}
+	}
+	return compiled, nil
+}
+
+// isHostAllowed checks if a client may claim the hostname. A client with a
+// certificate may use its common name or DNS names as hostname or any
+// hostname matching the patterns configured for one of its names.
+func (server *Server) isHostAllowed(conn net.Conn, hostname string) bool {
+	names := peerNames(conn)
+	if names == nil {
+		// Without a verified certificate the hostname can't be checked
+		return !server.config.TLS.RequireClientCert
+	}
+	for _, name := range names {
+		if name == hostname {
+			return true
+		}
+		for _, p := range server.tlsHosts[name] {
+			if p.Match(hostname) {
+				return true
+			}
+		}
+	}
+	log.Warn().Str("host", hostname).Strs("names", names).Msg("Hostname not allowed for client certificate")
+	return false
+}
@@ -0,0 +1,34 @@
+package loghamster
+
+import "testing"
+
+func TestCompileTLSHosts(t *testing.T) {
+	compiled, err := compileTLSHosts(map[string][]string{"relay": {"web*", "~sip[0-9]+", "~^db1$", "mail1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		"web1":              true,
+		"sip1":              true,
+		"sip12":             true,
+		"sip1.example":      false,
+		"evilsip1":          false,
+		"db1":               true,
+		"db10":              false,
+		"mail1":             true,
+		"mail10":            false,
+		"relay.example.com": false,
+	}
+	for hostname, allowed := range tests {
+		matched := false
+		for _, p := range compiled["relay"] {
+			matched = matched || p.Match(hostname)
+		}
+		if matched != allowed {
+			t.Errorf("%s: got %v, want %v", hostname, matched, allowed)
+		}
+	}
+	if _, err := compileTLSHosts(map[string][]string{"relay": {"~("}}); err == nil {
+		t.Error("invalid regex: expected error")
+	}
+}
@@ -0,0 +1,357 @@
+package loghamster
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression method for the data of a stream sent over the wire
+const (
+	CompressNone   = "none"
+	CompressSnappy = "snappy"
+)
+
+// countingWriter counts bytes written to the underlying writer
+type countingWriter struct {
+	w       io.Writer
+	counter *metrics.Counter
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.counter.Add(n)
+	return n, err
+}
+
+// isWireCompression returns true if the compression method is supported
+// for stream data on the wire
+func isWireCompression(method string) bool {
+	switch method {
+	case CompressGzip, CompressZstd, CompressSnappy:
+		return true
+	}
+	return false
+}
+
+// wireCodec compresses the payload of each data frame independently, so
+// every frame can be decoded on its own
+type wireCodec struct {
+	method  string
+	gzip    *gzip.Writer
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	buf     bytes.Buffer
+}
+
+// newWireCodec returns the codec for the compression method, nil for
+// data without compression
+func newWireCodec(method string) (*wireCodec, error) {
+	codec := wireCodec{method: method}
+	var err error
+	switch method {
+	case "", CompressNone:
+		return nil, nil
+	case CompressGzip:
+		codec.gzip = gzip.NewWriter(&codec.buf)
+	case CompressZstd:
+		codec.encoder, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err == nil {
+			codec.decoder, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxFrameSize))
+		}
+	case CompressSnappy:
+	default:
+		err = fmt.Errorf("unknown compression method %s", method)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &codec, nil
+}
+
+// Encode returns the compressed data
+func (codec *wireCodec) Encode(p []byte) ([]byte, error) {
+	switch codec.method {
+	case CompressGzip:
+		codec.buf.Reset()
+		codec.gzip.Reset(&codec.buf)
+		if _, err := codec.gzip.Write(p); err != nil {
+			return nil, err
+		}
+		if err := codec.gzip.Close(); err != nil {
+			return nil, err
+		}
+		return codec.buf.Bytes(), nil
+	case CompressZstd:
+		return codec.encoder.EncodeAll(p, nil), nil
+	case CompressSnappy:
+		return snappy.Encode(nil, p), nil
+	}
+	return p, nil
+}
+
+// Decode returns the decompressed data. Data decompressed to more than the
+// maximum frame size is rejected, so a small frame cannot exhaust memory.
+func (codec *wireCodec) Decode(p []byte) ([]byte, error) {
+	var data []byte
+	var err error
+	switch codec.method {
+	case CompressGzip:
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(bytes.NewReader(p)); err != nil {
+			return nil, err
+		}
+		data, err = ioutil.ReadAll(io.LimitReader(r, maxFrameSize+1))
+	case CompressZstd:
+		data, err = codec.decoder.DecodeAll(p, nil)
+		if err == zstd.ErrDecoderSizeExceeded || err == zstd.ErrWindowSizeExceeded {
+			err = errFrameTooLarge
+		}
+	case CompressSnappy:
+		var n int
+		if n, err = snappy.DecodedLen(p); err == nil && n > maxFrameSize {
+			return nil, errFrameTooLarge
+		}
+		if err == nil {
+			data, err = snappy.Decode(nil, p)
+		}
+	default:
+		return p, nil
+	}
+	if err == nil && len(data) > maxFrameSize {
+		err = errFrameTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Maximum payload size of a data frame accepted by the server, also the
+// maximum size of the decompressed data
+const maxFrameSize = 4 * 1024 * 1024
+
+// errFrameTooLarge is returned for data frames decompressed to more than
+// the maximum frame size
+var errFrameTooLarge = errors.New("decompressed data frame too large")
+
+// frameHeader describes the payload of a data frame
+type frameHeader struct {
+	offset  int64 // Source offset of the data
+	length  int   // Length of the payload
+	source  int   // Length of the source data covered, -1 if the data is the source
+	records []int // Number of lines of each record in the data, nil if not grouped
+}
+
+// String returns the arguments of the header following DATA.
+// Format: <offset> <length> [<source length>] [records:<lines>,<lines>*<count>,...]
+func (h frameHeader) String() string {
+	header := fmt.Sprintf("%d %d", h.offset, h.length)
+	if h.source >= 0 {
+		header = header + " " + strconv.Itoa(h.source)
+	}
+	if len(h.records) > 0 {
+		header = header + " records:" + formatRecords(h.records)
+	}
+	return header
+}
+
+// writeFrame sends a data frame with the source offset of the data. The
+// source length is only sent if the data differs from the source, like
+// lines truncated in line mode.
+// Format: DATA <offset> <length> [<source length>] [records:...]\n<payload>
+func writeFrame(w io.Writer, h frameHeader, payload []byte) error {
+	h.length = len(payload)
+	header := "DATA " + h.String() + "\n"
+	frame := make([]byte, 0, len(header)+len(payload))
+	frame = append(append(frame, header...), payload...)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame reads a data frame and returns its header and payload. The
+// number of bytes read is counted in the wire metric. The payload of
+// compressed frames may hold more records than bytes.
+func readFrame(r *bufio.Reader, compressed bool) (frameHeader, []byte, error) {
+	line, err := r.ReadString('\n')
+	metricBytesRecvWireTotal.Add(len(line))
+	if err != nil {
+		if err == io.EOF && line != "" {
+			err = io.ErrUnexpectedEOF
+		}
+		return frameHeader{}, nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 1 || fields[0] != "DATA" {
+		return frameHeader{}, nil, fmt.Errorf("invalid data frame: %s", strings.TrimSpace(line))
+	}
+	h, err := parseFrameHeader(fields[1:], compressed)
+	if err != nil {
+		return h, nil, fmt.Errorf("invalid data frame: %s", strings.TrimSpace(line))
+	}
+	payload, err := readPayload(r, h.length)
+	return h, payload, err
+}
+
+// parseFrameHeader parses the offset, payload length, optional source
+// length and records of a data frame. Each line of a record takes at least
+// a byte, so the records are bounded by the payload length, or by the
+// maximum frame size if the payload is compressed.
+func parseFrameHeader(args []string, compressed bool) (frameHeader, error) {
+	h := frameHeader{source: -1}
+	var err error
+	var numbers []string
+	records := ""
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "records:") {
+			records = strings.TrimPrefix(arg, "records:")
+			continue
+		}
+		numbers = append(numbers, arg)
+	}
+	if len(numbers) < 2 || len(numbers) > 3 {
+		return h, fmt.Errorf("invalid number of arguments")
+	}
+	if h.offset, err = strconv.ParseInt(numbers[0], 10, 64); err != nil || h.offset < 0 {
+		return h, fmt.Errorf("invalid offset %s", numbers[0])
+	}
+	if h.length, err = strconv.Atoi(numbers[1]); err != nil {
+		return h, fmt.Errorf("invalid length %s", numbers[1])
+	}
+	if len(numbers) == 3 {
+		if h.source, err = strconv.Atoi(numbers[2]); err != nil || h.source < 0 {
+			return h, fmt.Errorf("invalid source length %s", numbers[2])
+		}
+	}
+	if records != "" {
+		limit := h.length
+		if compressed {
+			limit = maxFrameSize
+		}
+		if h.records, err = parseRecords(records, limit); err != nil {
+			return h, err
+		}
+	}
+	return h, nil
+}
+
+// formatRecords returns the number of lines of the records, with repeated
+// counts written once (1*200 for 200 records of a single line)
+func formatRecords(records []int) string {
+	var parts []string
+	for i := 0; i < len(records); {
+		n := 1
+		for i+n < len(records) && records[i+n] == records[i] {
+			n++
+		}
+		part := strconv.Itoa(records[i])
+		if n > 1 {
+			part = part + "*" + strconv.Itoa(n)
+		}
+		parts = append(parts, part)
+		i = i + n
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseRecords parses the number of lines of records written by
+// formatRecords. The records are only expanded if they hold at most limit
+// lines in total.
+func parseRecords(arg string, limit int) ([]int, error) {
+	type run struct{ lines, count int }
+	var runs []run
+	total, size := 0, 0
+	for _, part := range strings.Split(arg, ",") {
+		lines, count := part, "1"
+		if i := strings.IndexByte(part, '*'); i >= 0 {
+			lines, count = part[:i], part[i+1:]
+		}
+		l, err := strconv.Atoi(lines)
+		if err != nil || l < 1 || l > limit {
+			return nil, fmt.Errorf("invalid records %s", arg)
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 1 || n > (limit-total)/l {
+			return nil, fmt.Errorf("invalid records %s", arg)
+		}
+		total = total + l*n
+		size = size + n
+		runs = append(runs, run{l, n})
+	}
+	records := make([]int, 0, size)
+	for _, r := range runs {
+		for n := r.count; n > 0; n-- {
+			records = append(records, r.lines)
+		}
+	}
+	return records, nil
+}
+
+// splitRecords splits the data of a frame into records of lines. Without
+// records every line is a record of its own, including a last line without
+// line break. Otherwise the data must end with a line break.
+func splitRecords(data []byte, records []int) ([][]byte, error) {
+	var result [][]byte
+	for len(data) > 0 {
+		lines := 1
+		if records != nil {
+			if len(result) >= len(records) {
+				return result, fmt.Errorf("more lines than records")
+			}
+			lines = records[len(result)]
+		}
+		end := 0
+		for ; lines > 0; lines-- {
+			nl := bytes.IndexByte(data[end:], '\n')
+			if nl < 0 && records == nil {
+				end = len(data)
+				break
+			}
+			if nl < 0 {
+				return result, fmt.Errorf("incomplete record")
+			}
+			end = end + nl + 1
+		}
+		result = append(result, data[:end])
+		data = data[end:]
+	}
+	if records != nil && len(result) != len(records) {
+		return result, fmt.Errorf("fewer lines than records")
+	}
+	return result, nil
+}
+
+// readPayload reads the payload of a data frame following the header
+func readPayload(r *bufio.Reader, length int) ([]byte, error) {
+	if length < 0 || length > maxFrameSize {
+		return nil, fmt.Errorf("invalid data frame length %d", length)
+	}
+	payload := make([]byte, length)
+	n, err := io.ReadFull(r, payload)
+	metricBytesRecvWireTotal.Add(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return payload, err
+}
+
+// responseArg returns the value of a key:value argument of the OK
+// response to INIT, like the accepted compression method
+func responseArg(line string, key string) (string, bool) {
+	for _, arg := range strings.Fields(line) {
+		if strings.HasPrefix(arg, key+":") {
+			return strings.TrimPrefix(arg, key+":"), true
+		}
+	}
+	return "", false
+}
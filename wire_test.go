@@ -0,0 +1,212 @@
+package loghamster
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWireCodecRoundTrip(t *testing.T) {
+	payloads := [][]byte{
+		[]byte("one line\n"),
+		[]byte(strings.Repeat("repeated line of a log file\n", 10000)),
+		bytes.Repeat([]byte{0}, maxFrameSize),
+	}
+	for _, method := range []string{CompressGzip, CompressZstd, CompressSnappy} {
+		codec, err := newWireCodec(method)
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		for _, payload := range payloads {
+			encoded, err := codec.Encode(payload)
+			if err != nil {
+				t.Fatalf("%s: encode: %v", method, err)
+			}
+			decoded, err := codec.Decode(append([]byte{}, encoded...))
+			if err != nil {
+				t.Fatalf("%s: decode %d bytes: %v", method, len(payload), err)
+			}
+			if !bytes.Equal(decoded, payload) {
+				t.Errorf("%s: decoded %d bytes, want %d", method, len(decoded), len(payload))
+			}
+		}
+	}
+}
+
+func TestWireCodecSizeCap(t *testing.T) {
+	bomb := bytes.Repeat([]byte{0}, maxFrameSize+1)
+	for _, method := range []string{CompressGzip, CompressZstd, CompressSnappy} {
+		codec, err := newWireCodec(method)
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		encoded, err := codec.Encode(bomb)
+		if err != nil {
+			t.Fatalf("%s: encode: %v", method, err)
+		}
+		if _, err := codec.Decode(append([]byte{}, encoded...)); err != errFrameTooLarge {
+			t.Errorf("%s: decode %d bytes: got error %v, want %v", method, len(bomb), err, errFrameTooLarge)
+		}
+	}
+}
+
+func TestNewWireCodec(t *testing.T) {
+	for _, method := range []string{"", CompressNone} {
+		if codec, err := newWireCodec(method); codec != nil || err != nil {
+			t.Errorf("%q: got %v, %v, want no codec", method, codec, err)
+		}
+	}
+	if _, err := newWireCodec("lzma"); err == nil {
+		t.Error("lzma: expected error")
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		header  frameHeader
+		payload string
+		line    string
+	}{
+		{frameHeader{offset: 0, source: -1}, "a\n", "DATA 0 2\n"},
+		{frameHeader{offset: 1234567890123, source: -1}, "", "DATA 1234567890123 0\n"},
+		{frameHeader{offset: 10, source: 40}, "truncated [...]\n", "DATA 10 16 40\n"},
+		{frameHeader{offset: 5, source: -1, records: []int{1, 1, 3}}, "a\nb\nc\nd\ne\n", "DATA 5 10 records:1*2,3\n"},
+		{frameHeader{offset: 7, source: 9, records: []int{2}}, "x\ny\n", "DATA 7 4 9 records:2\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := writeFrame(&buf, test.header, []byte(test.payload)); err != nil {
+			t.Fatal(err)
+		}
+		if line, _ := buf.ReadString('\n'); line != test.line {
+			t.Errorf("header %q, want %q", line, test.line)
+		}
+		buf.Reset()
+		writeFrame(&buf, test.header, []byte(test.payload))
+		h, payload, err := readFrame(bufio.NewReader(&buf), false)
+		if err != nil {
+			t.Fatalf("%q: %v", test.line, err)
+		}
+		want := test.header
+		want.length = len(test.payload)
+		if !reflect.DeepEqual(h, want) || string(payload) != test.payload {
+			t.Errorf("%q: got %+v %q, want %+v %q", test.line, h, payload, want, test.payload)
+		}
+	}
+}
+
+func TestReadFrameInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"DATA 0 5\nabc",
+		"DATA 0\n",
+		"DATA -1 0\n",
+		"DATA 0 1 2 3\n",
+		"DATA 0 x\n",
+		"DATA 0 0 -2\n",
+		"DATA 0 0 records:0\n",
+		"DATA 0 99999999\n",
+		"DATA 0 2 records:1*3\n",
+		"DATA 0 0 records:1*4194304\n",
+		"PING\n",
+	}
+	for _, test := range tests {
+		if _, _, err := readFrame(bufio.NewReader(strings.NewReader(test)), false); err == nil {
+			t.Errorf("%q: expected error", test)
+		}
+	}
+}
+
+func TestParseFrameHeaderRecordsLimit(t *testing.T) {
+	args := []string{"0", "2", "records:1*3"}
+	if _, err := parseFrameHeader(args, false); err == nil {
+		t.Errorf("%q: expected error for 3 lines in 2 bytes", args)
+	}
+	// Compressed payloads may hold more lines than bytes
+	if h, err := parseFrameHeader(args, true); err != nil || len(h.records) != 3 {
+		t.Errorf("%q compressed: got %v, %v", args, h.records, err)
+	}
+	args = []string{"0", "2", "records:1*4194305"}
+	if _, err := parseFrameHeader(args, true); err == nil {
+		t.Errorf("%q compressed: expected error beyond maximum frame size", args)
+	}
+}
+
+func TestParseRecords(t *testing.T) {
+	tests := []struct {
+		arg     string
+		records []int
+	}{
+		{"1", []int{1}},
+		{"1*3", []int{1, 1, 1}},
+		{"2,1*2,5", []int{2, 1, 1, 5}},
+		{"", nil},
+		{"0", nil},
+		{"1*0", nil},
+		{"1*x", nil},
+		{"a", nil},
+		{"1*99999999", nil},
+		{"2*2097153", nil},
+		{"4194305", nil},
+	}
+	for _, test := range tests {
+		records, err := parseRecords(test.arg, maxFrameSize)
+		if test.records == nil {
+			if err == nil {
+				t.Errorf("%q: expected error, got %v", test.arg, records)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(records, test.records) {
+			t.Errorf("%q: got %v, %v, want %v", test.arg, records, err, test.records)
+		}
+		if arg := formatRecords(records); arg != test.arg {
+			t.Errorf("formatRecords(%v) = %q, want %q", records, arg, test.arg)
+		}
+	}
+}
+
+func TestSplitRecords(t *testing.T) {
+	tests := []struct {
+		data    string
+		records []int
+		want    []string
+		err     bool
+	}{
+		{"a\nb\n", nil, []string{"a\n", "b\n"}, false},
+		{"a\nb", nil, []string{"a\n", "b"}, false},
+		{"", nil, nil, false},
+		{"a\nb\nc\n", []int{2, 1}, []string{"a\nb\n", "c\n"}, false},
+		{"a\nb\nc\n", []int{1}, []string{"a\n"}, true},
+		{"a\nb\n", []int{1, 1, 1}, []string{"a\n", "b\n"}, true},
+		{"a\nb", []int{1, 1}, []string{"a\n"}, true},
+	}
+	for _, test := range tests {
+		records, err := splitRecords([]byte(test.data), test.records)
+		if (err != nil) != test.err {
+			t.Errorf("%q %v: got error %v", test.data, test.records, err)
+		}
+		var got []string
+		for _, record := range records {
+			got = append(got, string(record))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q %v: got %q, want %q", test.data, test.records, got, test.want)
+		}
+	}
+}
+
+func TestResponseArg(t *testing.T) {
+	line := "OK abc 0 offset:42 compress:zstd"
+	if value, ok := responseArg(line, "offset"); !ok || value != "42" {
+		t.Errorf("offset: got %q, %v", value, ok)
+	}
+	if value, ok := responseArg(line, "compress"); !ok || value != "zstd" {
+		t.Errorf("compress: got %q, %v", value, ok)
+	}
+	if _, ok := responseArg(line, "records"); ok {
+		t.Error("records: unexpected argument")
+	}
+}